@@ -0,0 +1,26 @@
+// Helpers shared by the packages that watch files with fsnotify. Being internal, they are not
+// part of the public API of any provider.
+//
+package fswatch
+
+import (
+	fsnotify "github.com/howeyc/fsnotify"
+)
+
+// Drain consumes a closed watcher's channels so its internal goroutines can exit.
+// It returns once both channels have been closed by fsnotify.
+func Drain(watcher *fsnotify.Watcher) {
+	events, errs := watcher.Event, watcher.Error
+	for events != nil || errs != nil {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		}
+	}
+}
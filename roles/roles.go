@@ -2,10 +2,19 @@
 // mechanisms, most likely regular text files (see the roles_files.go implementation).
 package roles
 
+import (
+	"time"
+)
+
 type RolesFields struct {
 	AccessKey string
 	Secret    string
 	Token     string
+	// Expiration is when temporary credentials stop being valid. The zero value means the
+	// expiration is not known, or the credentials do not expire.
+	Expiration time.Time
+	// IssuedAt is when the credentials were issued, if the provider knows it.
+	IssuedAt time.Time
 }
 
 // NewRolesFields returns a pointer to a RolesFields instance.
@@ -23,6 +32,22 @@ func (rf *RolesFields) ZeroRoles() {
 	rf.AccessKey = ""
 	rf.Secret = ""
 	rf.Token = ""
+	rf.Expiration = time.Time{}
+	rf.IssuedAt = time.Time{}
+}
+
+// ExpiresAt returns the Expiration and true, or false if the expiration is not known.
+func (rf *RolesFields) ExpiresAt() (time.Time, bool) {
+	return rf.Expiration, !rf.Expiration.IsZero()
+}
+
+// IsExpired reports whether the credentials expire within skew of now. Credentials with an
+// unknown expiration are never considered expired.
+func (rf *RolesFields) IsExpired(skew time.Duration) bool {
+	if rf.Expiration.IsZero() {
+		return false
+	}
+	return !time.Now().Add(skew).Before(rf.Expiration)
 }
 
 // RolesReader is our interface to describe the functionality for roles credential information.
@@ -57,3 +82,37 @@ type RolesReader interface {
 	// interface may panic if there is no out-of-band updating defined.
 	RolesWatch(c chan error, s chan bool)
 }
+
+// RolesExpirer is an optional interface for RolesReader implementations that can report when
+// their credentials expire. Callers should type-assert a RolesReader to find out if it is supported.
+type RolesExpirer interface {
+	// ExpiresAt returns the expiration time of the current credentials, and false if it is not known.
+	ExpiresAt() (time.Time, bool)
+	// IsExpired reports whether the current credentials expire within skew of now.
+	IsExpired(skew time.Duration) bool
+}
+
+// RolesRereader is an optional interface for RolesReader implementations that can read their
+// source again without giving up their current credentials if the read fails. Callers that
+// re-read speculatively, such as after a rejected request, should only do so through it.
+type RolesRereader interface {
+	// RolesReread reads like RolesRead, but leaves the current credentials in place on failure.
+	RolesReread() error
+}
+
+// ExpiresAt returns the expiration of r's credentials if r implements RolesExpirer and knows it.
+func ExpiresAt(r RolesReader) (time.Time, bool) {
+	if re, ok := r.(RolesExpirer); ok {
+		return re.ExpiresAt()
+	}
+	return time.Time{}, false
+}
+
+// IsExpired reports whether r's credentials expire within skew of now. Readers that do not
+// implement RolesExpirer are never considered expired.
+func IsExpired(r RolesReader, skew time.Duration) bool {
+	if re, ok := r.(RolesExpirer); ok {
+		return re.IsExpired(skew)
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package roles
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Credentials is an immutable snapshot of one generation of credentials. Unlike calling
+// GetAccessKey, GetSecret and GetToken in turn, all of its fields are guaranteed to come from
+// the same load. Credentials values must not be modified once returned.
+type Credentials struct {
+	AccessKey string
+	Secret    string
+	Token     string
+	// Provider is the ProviderType of the reader that loaded the credentials.
+	Provider string
+	// LoadedAt is when the reader loaded the credentials. It is zero if not known.
+	LoadedAt time.Time
+	// Generation counts the loads made by the reader, starting at 1. It is 0 if the reader
+	// does not track generations.
+	Generation uint64
+	// Expiration is when the credentials stop being valid. It is zero if not known.
+	Expiration time.Time
+}
+
+// ExpiresAt returns the Expiration and true, or false if the expiration is not known.
+func (c *Credentials) ExpiresAt() (time.Time, bool) {
+	return c.Expiration, !c.Expiration.IsZero()
+}
+
+// IsExpired reports whether the credentials expire within skew of now. Credentials with an
+// unknown expiration are never considered expired.
+func (c *Credentials) IsExpired(skew time.Duration) bool {
+	if c.Expiration.IsZero() {
+		return false
+	}
+	return !time.Now().Add(skew).Before(c.Expiration)
+}
+
+// RolesSnapshotter is an optional interface for RolesReader implementations that can return
+// their current credentials as a single Credentials snapshot.
+type RolesSnapshotter interface {
+	// Credentials returns the current snapshot, or an error if no credentials are loaded.
+	Credentials() (*Credentials, error)
+}
+
+// Snapshot returns r's current credentials as one Credentials value. If r does not implement
+// RolesSnapshotter, the snapshot is built from Get and ExpiresAt, with no LoadedAt or Generation.
+func Snapshot(r RolesReader) (*Credentials, error) {
+	if rs, ok := r.(RolesSnapshotter); ok {
+		return rs.Credentials()
+	}
+	accessKey, secret, token, get_err := r.Get()
+	if get_err != nil {
+		e := fmt.Sprintf("roles.Snapshot: %s", get_err.Error())
+		return nil, errors.New(e)
+	}
+	c := &Credentials{
+		AccessKey: accessKey,
+		Secret:    secret,
+		Token:     token,
+		Provider:  r.ProviderType(),
+	}
+	c.Expiration, _ = ExpiresAt(r)
+	return c, nil
+}
+
+// CredentialsStore holds the current Credentials of a reader behind an atomic pointer, so
+// Load never blocks on the reader's lock. The zero value is ready to use and holds nothing.
+type CredentialsStore struct {
+	current    atomic.Value
+	generation uint64
+}
+
+// Store publishes a new snapshot of fields as the next generation and returns it.
+func (cs *CredentialsStore) Store(provider string, fields *RolesFields) *Credentials {
+	c := &Credentials{
+		AccessKey:  fields.AccessKey,
+		Secret:     fields.Secret,
+		Token:      fields.Token,
+		Provider:   provider,
+		LoadedAt:   time.Now(),
+		Generation: atomic.AddUint64(&cs.generation, 1),
+		Expiration: fields.Expiration,
+	}
+	cs.current.Store(c)
+	return c
+}
+
+// Zero removes the current snapshot. The generation count is kept.
+func (cs *CredentialsStore) Zero() {
+	cs.current.Store((*Credentials)(nil))
+}
+
+// Load returns the current snapshot, or nil if there is none.
+func (cs *CredentialsStore) Load() *Credentials {
+	c, _ := cs.current.Load().(*Credentials)
+	return c
+}
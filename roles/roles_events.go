@@ -0,0 +1,123 @@
+package roles
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DEFAULT_EVENT_BUFFER is the channel buffer used for subscribers that do not choose one.
+const DEFAULT_EVENT_BUFFER = 16
+
+// EventType says what happened to a reader's credentials.
+type EventType int
+
+const (
+	// Rotated means a new generation of credentials was loaded.
+	Rotated EventType = iota + 1
+	// ReadFailed means a read failed. Err holds the reason.
+	ReadFailed
+	// Zeroed means the credentials were cleared.
+	Zeroed
+	// Expiring means the current credentials are close to their Expiration.
+	Expiring
+)
+
+// String returns the name of t.
+func (t EventType) String() string {
+	switch t {
+	case Rotated:
+		return "Rotated"
+	case ReadFailed:
+		return "ReadFailed"
+	case Zeroed:
+		return "Zeroed"
+	case Expiring:
+		return "Expiring"
+	}
+	return "Unknown"
+}
+
+// Event describes one change to a reader's credentials. Generations are those of the
+// reader's Credentials snapshots; 0 means there were no credentials.
+type Event struct {
+	Type          EventType
+	Provider      string
+	OldGeneration uint64
+	NewGeneration uint64
+	// Expiration is the expiration of the credentials after the event, if known.
+	Expiration time.Time
+	// Err is set for ReadFailed.
+	Err  error
+	Time time.Time
+}
+
+// RolesSubscriber is an optional interface for RolesReader implementations that publish
+// Events. Callers should type-assert a RolesReader to find out if it is supported.
+type RolesSubscriber interface {
+	// Subscribe returns a channel receiving Events, buffered to hold buffer of them, and a
+	// func that ends the subscription and closes the channel.
+	Subscribe(buffer int) (<-chan Event, func())
+	// SubscribeFunc calls f with each Event on a goroutine of its own, until the returned
+	// func is called.
+	SubscribeFunc(f func(Event)) func()
+}
+
+// Notifier fans Events out to any number of subscribers. Publish never blocks: an Event that
+// does not fit in a subscriber's buffer is dropped for that subscriber only, so a slow
+// subscriber cannot stall the goroutine watching for new credentials. The zero value is
+// ready to use.
+type Notifier struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+// Subscribe implements RolesSubscriber. A buffer below 1 means DEFAULT_EVENT_BUFFER.
+func (n *Notifier) Subscribe(buffer int) (<-chan Event, func()) {
+	if buffer < 1 {
+		buffer = DEFAULT_EVENT_BUFFER
+	}
+	events := make(chan Event, buffer)
+	n.lock.Lock()
+	if n.subscribers == nil {
+		n.subscribers = make(map[chan Event]bool)
+	}
+	n.subscribers[events] = true
+	n.lock.Unlock()
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			n.lock.Lock()
+			delete(n.subscribers, events)
+			n.lock.Unlock()
+			close(events)
+		})
+	}
+}
+
+// SubscribeFunc implements RolesSubscriber.
+func (n *Notifier) SubscribeFunc(f func(Event)) func() {
+	events, unsubscribe := n.Subscribe(DEFAULT_EVENT_BUFFER)
+	go func() {
+		for ev := range events {
+			f(ev)
+		}
+	}()
+	return unsubscribe
+}
+
+// Publish sends ev to every subscriber that has room for it. If ev.Time is zero it is set to now.
+func (n *Notifier) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for events := range n.subscribers {
+		select {
+		case events <- ev:
+		default:
+			log.Printf("roles.Publish: subscriber buffer full, dropping %s event\n", ev.Type)
+		}
+	}
+}
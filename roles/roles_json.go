@@ -0,0 +1,89 @@
+package roles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RolesJSON is the JSON document shape used by AWS for temporary credentials: the EC2 instance
+// metadata service, the ECS container endpoint, `aws sts` output and credential_process all
+// emit some variant of it.
+type RolesJSON struct {
+	Version         int        `json:",omitempty"`
+	Code            string     `json:",omitempty"`
+	Message         string     `json:",omitempty"`
+	AccessKeyId     string     `json:",omitempty"`
+	SecretAccessKey string     `json:",omitempty"`
+	Token           string     `json:",omitempty"`
+	SessionToken    string     `json:",omitempty"`
+	Expiration      string     `json:",omitempty"`
+	LastUpdated     string     `json:",omitempty"`
+	Credentials     *RolesJSON `json:",omitempty"`
+}
+
+// ParseRolesJSON decodes b into a RolesFields. The token may be named either Token or
+// SessionToken, and the credentials may be nested under a Credentials key as in `aws sts` output.
+// Error messages never include credential values.
+func ParseRolesJSON(b []byte) (*RolesFields, error) {
+	var rj RolesJSON
+	json_err := DecodeRolesJSON(b, &rj)
+	if json_err != nil {
+		return nil, json_err
+	}
+	return rj.RolesFields()
+}
+
+// DecodeRolesJSON decodes b into rj without validating it, for callers that need to inspect
+// fields such as Version before calling RolesFields.
+func DecodeRolesJSON(b []byte, rj *RolesJSON) error {
+	json_err := json.Unmarshal(b, rj)
+	if json_err != nil {
+		e := fmt.Sprintf("roles.DecodeRolesJSON: cannot decode json: %s", json_err.Error())
+		return errors.New(e)
+	}
+	return nil
+}
+
+// RolesFields converts the document into a RolesFields, validating that an AccessKeyId and
+// SecretAccessKey are present and that any timestamps are RFC3339.
+func (rj *RolesJSON) RolesFields() (*RolesFields, error) {
+	if rj.AccessKeyId == "" && rj.Credentials != nil {
+		return rj.Credentials.RolesFields()
+	}
+	if rj.Code != "" && rj.Code != "Success" {
+		e := fmt.Sprintf("roles.RolesJSON: credentials Code is %s: %s", rj.Code, rj.Message)
+		return nil, errors.New(e)
+	}
+	if rj.AccessKeyId == "" {
+		return nil, errors.New("roles.RolesJSON: empty AccessKeyId")
+	}
+	if rj.SecretAccessKey == "" {
+		return nil, errors.New("roles.RolesJSON: empty SecretAccessKey")
+	}
+	rf := NewRolesFields()
+	rf.AccessKey = rj.AccessKeyId
+	rf.Secret = rj.SecretAccessKey
+	rf.Token = rj.Token
+	if rf.Token == "" {
+		rf.Token = rj.SessionToken
+	}
+	if rj.Expiration != "" {
+		t, t_err := time.Parse(time.RFC3339, rj.Expiration)
+		if t_err != nil {
+			e := fmt.Sprintf("roles.RolesJSON: bad Expiration: %s", t_err.Error())
+			return nil, errors.New(e)
+		}
+		rf.Expiration = t
+	}
+	if rj.LastUpdated != "" {
+		t, t_err := time.Parse(time.RFC3339, rj.LastUpdated)
+		if t_err != nil {
+			e := fmt.Sprintf("roles.RolesJSON: bad LastUpdated: %s", t_err.Error())
+			return nil, errors.New(e)
+		}
+		rf.IssuedAt = t
+	}
+	return rf, nil
+}
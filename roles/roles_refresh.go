@@ -0,0 +1,105 @@
+package roles
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DEFAULT_REFRESH_WINDOW is how far ahead of Expiration a Refresher fetches new credentials.
+	DEFAULT_REFRESH_WINDOW = 5 * time.Minute
+	// DEFAULT_REFRESH_INTERVAL is how often a Refresher fetches credentials with no known Expiration.
+	DEFAULT_REFRESH_INTERVAL = 15 * time.Minute
+	// DEFAULT_REFRESH_RETRY is how long a Refresher waits after a failed fetch.
+	DEFAULT_REFRESH_RETRY = 30 * time.Second
+)
+
+// Refresher implements the RolesWatch loop for providers that fetch expiring credentials from
+// a service rather than being notified of changes. Zero fields take the DEFAULT_REFRESH_ values.
+type Refresher struct {
+	// Window is how far ahead of Expiration to fetch new credentials.
+	Window time.Duration
+	// Interval is how often to fetch when the Expiration is not known.
+	Interval time.Duration
+	// Retry is how long to wait after a failed fetch before trying again.
+	Retry time.Duration
+}
+
+// Next returns how long to wait before refreshing credentials that expire at expiration,
+// or after Interval if known is false.
+func (r Refresher) Next(expiration time.Time, known bool) time.Duration {
+	if !known {
+		if r.Interval <= 0 {
+			return DEFAULT_REFRESH_INTERVAL
+		}
+		return r.Interval
+	}
+	window := r.Window
+	if window <= 0 {
+		window = DEFAULT_REFRESH_WINDOW
+	}
+	d := expiration.Add(-window).Sub(time.Now())
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (r Refresher) retry() time.Duration {
+	if r.Retry <= 0 {
+		return DEFAULT_REFRESH_RETRY
+	}
+	return r.Retry
+}
+
+// Watch calls refresh ahead of the expiration reported by expires until ctx is done.
+// Each successful refresh is signalled on read_signal, unless it is nil, and each failure is
+// sent on err_chan, after which refresh is retried after Retry. The current credentials are
+// left in place on failure, as they remain valid until they expire. When ctx is done,
+// ctx.Err() is sent on err_chan as the final value.
+func (r Refresher) Watch(ctx context.Context, err_chan chan error, read_signal chan bool,
+	refresh func() error, expires func() (time.Time, bool)) {
+	r.WatchNotify(ctx, err_chan, read_signal, nil, refresh, expires)
+}
+
+// WatchNotify is Watch with an additional trigger: a refresh also happens whenever a value is
+// received on notify, for providers whose inputs (such as a token file) can change before
+// the credentials expire. A nil notify channel is never ready.
+func (r Refresher) WatchNotify(ctx context.Context, err_chan chan error, read_signal chan bool,
+	notify <-chan bool, refresh func() error, expires func() (time.Time, bool)) {
+	wait := r.Next(expires())
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err_chan <- ctx.Err()
+			return
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+		refresh_err := refresh()
+		if refresh_err != nil {
+			wait = r.retry()
+			select {
+			case err_chan <- refresh_err:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		wait = r.Next(expires())
+		if wait == 0 {
+			// the source is handing out credentials already inside the window;
+			// don't spin on it
+			wait = r.retry()
+		}
+		if read_signal == nil {
+			continue
+		}
+		select {
+		case read_signal <- true:
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package roles
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// static_reader is a minimal RolesReader that does not implement any of the optional interfaces.
+type static_reader struct {
+	fields RolesFields
+}
+
+func (s *static_reader) ProviderType() string { return "static" }
+func (s *static_reader) UsingIAM() bool       { return s.fields.Token != "" }
+func (s *static_reader) RolesRead() error     { return nil }
+func (s *static_reader) ZeroRoles()           { s.fields.ZeroRoles() }
+func (s *static_reader) IsEmpty() bool        { return s.fields.IsEmpty() }
+func (s *static_reader) Get() (string, string, string, error) {
+	if s.fields.AccessKey == "" {
+		return "", "", "", errors.New("static_reader: empty")
+	}
+	return s.fields.AccessKey, s.fields.Secret, s.fields.Token, nil
+}
+func (s *static_reader) GetAccessKey() (string, error)        { return s.fields.AccessKey, nil }
+func (s *static_reader) GetSecret() (string, error)           { return s.fields.Secret, nil }
+func (s *static_reader) GetToken() (string, error)            { return s.fields.Token, nil }
+func (s *static_reader) RolesWatch(c chan error, r chan bool) {}
+
+func TestZeroExpiration(t *testing.T) {
+	rf := NewRolesFields()
+	if _, known := rf.ExpiresAt(); known {
+		t.Errorf("a zero Expiration should not be known")
+	}
+	if rf.IsExpired(time.Hour) {
+		t.Errorf("a zero Expiration should never be expired")
+	}
+}
+
+func TestExpirationSkew(t *testing.T) {
+	rf := NewRolesFields()
+	rf.Expiration = time.Now().Add(time.Hour)
+	if at, known := rf.ExpiresAt(); !known || !at.Equal(rf.Expiration) {
+		t.Errorf("ExpiresAt: got %v %v", at, known)
+	}
+	if rf.IsExpired(0) {
+		t.Errorf("credentials an hour from expiring are not expired")
+	}
+	if rf.IsExpired(59 * time.Minute) {
+		t.Errorf("a skew short of the expiration should not be expired")
+	}
+	if !rf.IsExpired(61 * time.Minute) {
+		t.Errorf("a skew past the expiration should be expired")
+	}
+	rf.Expiration = time.Now().Add(-time.Second)
+	if !rf.IsExpired(0) {
+		t.Errorf("credentials in the past should be expired")
+	}
+	rf.ZeroRoles()
+	if _, known := rf.ExpiresAt(); known {
+		t.Errorf("ZeroRoles should clear the Expiration")
+	}
+}
+
+func TestExpiresAtNonExpirer(t *testing.T) {
+	r := &static_reader{fields: RolesFields{AccessKey: "a", Secret: "s"}}
+	if _, known := ExpiresAt(r); known {
+		t.Errorf("a reader without RolesExpirer should not know its expiration")
+	}
+	if IsExpired(r, time.Hour) {
+		t.Errorf("a reader without RolesExpirer should never be expired")
+	}
+}
+
+func TestParseRolesJSON(t *testing.T) {
+	rf, parse_err := ParseRolesJSON([]byte(`{"Code":"Success","AccessKeyId":"a","SecretAccessKey":"s",` +
+		`"Token":"t","SessionToken":"st","Expiration":"2030-01-02T03:04:05Z","LastUpdated":"2030-01-01T00:00:00Z"}`))
+	if parse_err != nil {
+		t.Fatal(parse_err.Error())
+	}
+	if rf.AccessKey != "a" || rf.Secret != "s" || rf.Token != "t" {
+		t.Errorf("unexpected fields: %+v", rf)
+	}
+	if !rf.Expiration.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("unexpected Expiration: %v", rf.Expiration)
+	}
+	if !rf.IssuedAt.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected IssuedAt: %v", rf.IssuedAt)
+	}
+
+	// SessionToken is used when there is no Token
+	rf, parse_err = ParseRolesJSON([]byte(`{"AccessKeyId":"a","SecretAccessKey":"s","SessionToken":"st"}`))
+	if parse_err != nil {
+		t.Fatal(parse_err.Error())
+	}
+	if rf.Token != "st" {
+		t.Errorf("expected the SessionToken, got %s", rf.Token)
+	}
+
+	// `aws sts` output nests the credentials
+	rf, parse_err = ParseRolesJSON([]byte(`{"Credentials":{"AccessKeyId":"na","SecretAccessKey":"ns",` +
+		`"SessionToken":"nt","Expiration":"2030-01-02T03:04:05Z"},"AssumedRoleUser":{"Arn":"arn"}}`))
+	if parse_err != nil {
+		t.Fatal(parse_err.Error())
+	}
+	if rf.AccessKey != "na" || rf.Secret != "ns" || rf.Token != "nt" || rf.Expiration.IsZero() {
+		t.Errorf("unexpected nested fields: %+v", rf)
+	}
+
+	bad := []string{
+		`{"Code":"Failure","Message":"no role","AccessKeyId":"a","SecretAccessKey":"s"}`,
+		`{"SecretAccessKey":"s"}`,
+		`{"AccessKeyId":"a"}`,
+		`{"AccessKeyId":"a","SecretAccessKey":"s","Expiration":"tomorrow"}`,
+		`{"AccessKeyId":`,
+	}
+	for _, b := range bad {
+		if _, parse_err := ParseRolesJSON([]byte(b)); parse_err == nil {
+			t.Errorf("expected an error parsing %s", b)
+		}
+	}
+}
+
+func TestRefresherNext(t *testing.T) {
+	var r Refresher
+	if d := r.Next(time.Time{}, false); d != DEFAULT_REFRESH_INTERVAL {
+		t.Errorf("unknown expiration: got %v", d)
+	}
+	r.Interval = time.Minute
+	if d := r.Next(time.Time{}, false); d != time.Minute {
+		t.Errorf("unknown expiration with Interval: got %v", d)
+	}
+	d := r.Next(time.Now().Add(time.Hour), true)
+	if d > time.Hour-DEFAULT_REFRESH_WINDOW || d < time.Hour-DEFAULT_REFRESH_WINDOW-time.Minute {
+		t.Errorf("expected about %v, got %v", time.Hour-DEFAULT_REFRESH_WINDOW, d)
+	}
+	r.Window = 2 * time.Hour
+	if d := r.Next(time.Now().Add(time.Hour), true); d != 0 {
+		t.Errorf("an expiration inside the window should refresh now, got %v", d)
+	}
+}
+
+func TestCredentialsSnapshot(t *testing.T) {
+	c := new(Credentials)
+	if _, known := c.ExpiresAt(); known {
+		t.Errorf("a zero Credentials Expiration should not be known")
+	}
+	if c.IsExpired(time.Hour) {
+		t.Errorf("a zero Credentials Expiration should never be expired")
+	}
+
+	// readers without RolesSnapshotter are snapshotted with Get
+	r := &static_reader{fields: RolesFields{AccessKey: "a", Secret: "s"}}
+	c, snap_err := Snapshot(r)
+	if snap_err != nil {
+		t.Fatal(snap_err.Error())
+	}
+	if c.AccessKey != "a" || c.Secret != "s" || c.Provider != "static" || c.Generation != 0 {
+		t.Errorf("unexpected snapshot: %+v", c)
+	}
+	r.ZeroRoles()
+	if _, snap_err := Snapshot(r); snap_err == nil {
+		t.Errorf("expected an error taking a snapshot of an empty reader")
+	}
+}
+
+func TestCredentialsStore(t *testing.T) {
+	var cs CredentialsStore
+	if cs.Load() != nil {
+		t.Errorf("a new CredentialsStore should hold nothing")
+	}
+	fields := &RolesFields{AccessKey: "a", Secret: "s", Token: "t", Expiration: time.Now().Add(time.Hour)}
+	c1 := cs.Store("test", fields)
+	if c1.Generation != 1 || c1.AccessKey != "a" || c1.Provider != "test" || c1.LoadedAt.IsZero() {
+		t.Errorf("unexpected first snapshot: %+v", c1)
+	}
+	// the snapshot does not change with the fields it was taken from
+	fields.AccessKey = "b"
+	if cs.Load() != c1 || c1.AccessKey != "a" {
+		t.Errorf("Load should return the stored snapshot unchanged")
+	}
+	cs.Zero()
+	if cs.Load() != nil {
+		t.Errorf("Zero should remove the snapshot")
+	}
+	c2 := cs.Store("test", fields)
+	if c2.Generation != 2 || c2.AccessKey != "b" {
+		t.Errorf("unexpected second snapshot: %+v", c2)
+	}
+}
+
+func TestNotifierFullBuffer(t *testing.T) {
+	var n Notifier
+	events, unsubscribe := n.Subscribe(1)
+	done := make(chan bool)
+	go func() {
+		// neither Publish may block on the full buffer
+		n.Publish(Event{Type: Rotated, NewGeneration: 1})
+		n.Publish(Event{Type: Rotated, NewGeneration: 2})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a full subscriber")
+	}
+	ev := <-events
+	if ev.NewGeneration != 1 || ev.Time.IsZero() {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+	select {
+	case ev = <-events:
+		t.Errorf("the second event should have been dropped, got %+v", ev)
+	default:
+	}
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Errorf("unsubscribe should close the channel")
+	}
+	// publishing after unsubscribe must not send on the closed channel
+	n.Publish(Event{Type: Zeroed})
+}
+
+func TestNotifierSubscribeFunc(t *testing.T) {
+	var n Notifier
+	got := make(chan Event, 1)
+	unsubscribe := n.SubscribeFunc(func(ev Event) { got <- ev })
+	defer unsubscribe()
+	n.Publish(Event{Type: Expiring})
+	select {
+	case ev := <-got:
+		if ev.Type != Expiring || ev.Type.String() != "Expiring" {
+			t.Errorf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SubscribeFunc was not called")
+	}
+}
+
+func TestRefresherWatchNilSignal(t *testing.T) {
+	r := Refresher{Interval: 10 * time.Millisecond}
+	refreshes := make(chan bool, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	err_chan := make(chan error, 1)
+	go r.Watch(ctx, err_chan, nil, func() error {
+		select {
+		case refreshes <- true:
+		default:
+		}
+		return nil
+	}, func() (time.Time, bool) { return time.Time{}, false })
+	// a nil read_signal must not stop the loop after the first refresh
+	for i := 0; i < 3; i++ {
+		select {
+		case <-refreshes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d refreshes with a nil read_signal", i)
+		}
+	}
+	cancel()
+	if watch_err := <-err_chan; watch_err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", watch_err)
+	}
+}
@@ -0,0 +1,130 @@
+// Adapts the RolesReader interface (roles.go) to aws-sdk-go (v1) credentials. CredentialsProvider
+// is a credentials.Provider whose credentials expire when RolesWatch re-reads the underlying
+// roles, or when their own expiration is near, so v1 clients pick up rotations without restarts.
+//
+package roles_awsv1
+
+import (
+	"errors"
+	"fmt"
+	credentials "github.com/aws/aws-sdk-go/aws/credentials"
+	roles "github.com/smugmug/goawsroles/roles"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "awsv1"
+
+	// DEFAULT_EXPIRY_WINDOW is how far ahead of a known expiration the credentials are
+	// reported as expired.
+	DEFAULT_EXPIRY_WINDOW = time.Minute
+)
+
+// CredentialsProvider is a credentials.Provider backed by a RolesReader.
+type CredentialsProvider struct {
+	Reader roles.RolesReader
+	// ExpiryWindow is how far ahead of a known expiration IsExpired becomes true.
+	ExpiryWindow time.Duration
+
+	retrieved bool
+	stale     bool
+	lock      sync.Mutex
+}
+
+// NewCredentialsProvider returns a pointer to a CredentialsProvider for r.
+func NewCredentialsProvider(r roles.RolesReader) *CredentialsProvider {
+	p := new(CredentialsProvider)
+	p.Reader = r
+	p.ExpiryWindow = DEFAULT_EXPIRY_WINDOW
+	return p
+}
+
+// NewCredentials returns credentials.Credentials backed by a new CredentialsProvider for r,
+// and the provider itself so that its RolesWatch can be run.
+func NewCredentials(r roles.RolesReader) (*credentials.Credentials, *CredentialsProvider) {
+	p := NewCredentialsProvider(r)
+	return credentials.NewCredentials(p), p
+}
+
+// Retrieve returns the current credentials of the RolesReader. The session token is set if
+// the reader returned one.
+func (p *CredentialsProvider) Retrieve() (credentials.Value, error) {
+	if p.Reader == nil {
+		return credentials.Value{}, errors.New("roles_awsv1.Retrieve: nil Reader")
+	}
+	// clear stale before reading, so that an Expire from a re-read that lands while Get is
+	// running is not lost
+	p.lock.Lock()
+	p.retrieved = true
+	p.stale = false
+	p.lock.Unlock()
+	accessKey, secret, token, get_err := p.Reader.Get()
+	if get_err != nil {
+		p.Expire()
+		e := fmt.Sprintf("roles_awsv1.Retrieve: %s: %s", p.Reader.ProviderType(), get_err.Error())
+		return credentials.Value{}, errors.New(e)
+	}
+	v := credentials.Value{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secret,
+		SessionToken:    token,
+		ProviderName:    "goawsroles:" + p.Reader.ProviderType(),
+	}
+	return v, nil
+}
+
+// IsExpired is true before the first Retrieve, after Expire (which RolesWatch calls on each
+// fresh read), and within ExpiryWindow of the reader's expiration if that is known.
+func (p *CredentialsProvider) IsExpired() bool {
+	p.lock.Lock()
+	expired := !p.retrieved || p.stale
+	p.lock.Unlock()
+	if expired {
+		return true
+	}
+	return p.Reader != nil && roles.IsExpired(p.Reader, p.ExpiryWindow)
+}
+
+// ExpiresAt implements credentials.Expirer, returning the reader's expiration if it is known
+// and the zero time otherwise.
+func (p *CredentialsProvider) ExpiresAt() time.Time {
+	if p.Reader == nil {
+		return time.Time{}
+	}
+	expiration, _ := roles.ExpiresAt(p.Reader)
+	return expiration
+}
+
+// Expire marks the current credentials as expired so that the next use of the
+// credentials.Credentials calls Retrieve. Callers consuming the read_signal channel of
+// Reader.RolesWatch themselves should call this on each signal.
+func (p *CredentialsProvider) Expire() {
+	p.lock.Lock()
+	p.stale = true
+	p.lock.Unlock()
+}
+
+// RolesWatch runs Reader.RolesWatch and calls Expire each time it signals a fresh read.
+// Errors are passed through on err_chan. If read_signal is not nil, each signal is also
+// forwarded to it after the credentials have been expired.
+func (p *CredentialsProvider) RolesWatch(err_chan chan error, read_signal chan bool) {
+	if p.Reader == nil {
+		err_chan <- errors.New("roles_awsv1.RolesWatch: nil Reader")
+		return
+	}
+	signals := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for s := range signals {
+			p.Expire()
+			if read_signal != nil {
+				read_signal <- s
+			}
+		}
+	}()
+	p.Reader.RolesWatch(err_chan, signals)
+	close(signals)
+	<-done
+}
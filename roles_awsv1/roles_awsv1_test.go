@@ -0,0 +1,135 @@
+package roles_awsv1
+
+import (
+	roles_env "github.com/smugmug/goawsroles/roles_env"
+	roles_files "github.com/smugmug/goawsroles/roles_files"
+	roles_master "github.com/smugmug/goawsroles/roles_master"
+	roles_simple "github.com/smugmug/goawsroles/roles_simple"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCredentialsProvider(t *testing.T) {
+	os.Setenv("TEST_AWSV1_"+roles_env.ACCESS_KEY_ENV, "key1")
+	os.Setenv("TEST_AWSV1_"+roles_env.SECRET_ENV, "secret")
+	os.Setenv("TEST_AWSV1_"+roles_env.TOKEN_ENV, "token")
+	defer os.Unsetenv("TEST_AWSV1_" + roles_env.ACCESS_KEY_ENV)
+	defer os.Unsetenv("TEST_AWSV1_" + roles_env.SECRET_ENV)
+	defer os.Unsetenv("TEST_AWSV1_" + roles_env.TOKEN_ENV)
+	re := roles_env.NewRolesEnvPrefix("TEST_AWSV1_")
+	if rr_err := re.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+
+	creds, p := NewCredentials(re)
+	v, v_err := creds.Get()
+	if v_err != nil {
+		t.Fatal(v_err.Error())
+	}
+	if v.AccessKeyID != "key1" || v.SessionToken != "token" {
+		t.Errorf("unexpected credentials: %+v", v)
+	}
+
+	if p.IsExpired() {
+		t.Errorf("credentials should not be expired after creds.Get")
+	}
+
+	p = NewCredentialsProvider(re)
+	if !p.IsExpired() {
+		t.Errorf("credentials should be expired before the first Retrieve")
+	}
+	if _, r_err := p.Retrieve(); r_err != nil {
+		t.Fatal(r_err.Error())
+	}
+	if p.IsExpired() {
+		t.Errorf("credentials should not be expired after Retrieve")
+	}
+	p.Expire()
+	if !p.IsExpired() {
+		t.Errorf("credentials should be expired after Expire")
+	}
+}
+
+func TestCredentialsProviderExpiration(t *testing.T) {
+	rs := roles_simple.NewRolesSimpleWithExpiration("key", "secret", "token", time.Now().Add(30*time.Second))
+	p := NewCredentialsProvider(rs)
+	if _, r_err := p.Retrieve(); r_err != nil {
+		t.Fatal(r_err.Error())
+	}
+	if !p.IsExpired() {
+		t.Errorf("credentials inside the expiry window should be expired")
+	}
+	if p.ExpiresAt().IsZero() {
+		t.Errorf("expected a known expiration")
+	}
+
+	rm := roles_master.NewRolesMaster("masterkey", "mastersecret")
+	p = NewCredentialsProvider(rm)
+	v, r_err := p.Retrieve()
+	if r_err != nil {
+		t.Fatal(r_err.Error())
+	}
+	if v.SessionToken != "" || p.IsExpired() {
+		t.Errorf("master credentials should carry no token and not expire: %+v", v)
+	}
+}
+
+func TestCredentialsProviderRolesWatch(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_awsv1")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	write_role := func(accessKey string) {
+		// rename into place, as credential writers should
+		tmp_file := filepath.Join(dir, "staging.tmp")
+		j := `{"AccessKeyId":"` + accessKey + `","SecretAccessKey":"secret","Token":"token"}`
+		if write_err := ioutil.WriteFile(tmp_file, []byte(j), 0600); write_err != nil {
+			t.Fatal(write_err.Error())
+		}
+		if rename_err := os.Rename(tmp_file, filepath.Join(dir, "role.json")); rename_err != nil {
+			t.Fatal(rename_err.Error())
+		}
+	}
+	write_role("oldkey")
+	rf := roles_files.NewRolesFiles()
+	rf.BaseDir = dir
+	rf.JSONFile = "role.json"
+	rf.SettleInterval = 100 * time.Millisecond
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+
+	creds, p := NewCredentials(rf)
+	v, v_err := creds.Get()
+	if v_err != nil {
+		t.Fatal(v_err.Error())
+	}
+	if v.AccessKeyID != "oldkey" {
+		t.Errorf("unexpected credentials: %+v", v)
+	}
+
+	c := make(chan error, 1)
+	s := make(chan bool)
+	go p.RolesWatch(c, s)
+	time.Sleep(500 * time.Millisecond)
+
+	write_role("newkey")
+	select {
+	case <-s:
+	case watch_err := <-c:
+		t.Fatalf("error from watcher: %v", watch_err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no re-read after rotation")
+	}
+	v, v_err = creds.Get()
+	if v_err != nil {
+		t.Fatal(v_err.Error())
+	}
+	if v.AccessKeyID != "newkey" || v.SessionToken != "token" {
+		t.Errorf("rotated credentials were not picked up: %+v", v)
+	}
+}
@@ -0,0 +1,263 @@
+// Adapts between the RolesReader interface (roles.go) and aws-sdk-go-v2 credentials.
+// CredentialsProvider wraps any RolesReader as an aws.CredentialsProvider, so SDK clients see
+// rotations made by RolesWatch. RolesProvider wraps any aws.CredentialsProvider as a
+// RolesReader, so SDK providers can feed godynamo.
+//
+package roles_awsv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aws "github.com/aws/aws-sdk-go-v2/aws"
+	roles "github.com/smugmug/goawsroles/roles"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "awsv2"
+
+	// DEFAULT_RETRIEVE_INTERVAL is how long SDK caches may hold IAM credentials whose
+	// expiration is not known, such as those from RolesFiles, before retrieving them again.
+	DEFAULT_RETRIEVE_INTERVAL = time.Minute
+	// DEFAULT_TIMEOUT bounds RolesProvider calls to the wrapped provider.
+	DEFAULT_TIMEOUT = 30 * time.Second
+)
+
+// CredentialsProvider is an aws.CredentialsProvider backed by a RolesReader.
+type CredentialsProvider struct {
+	Reader roles.RolesReader
+	// RetrieveInterval is reported as the lifetime of IAM credentials with no known expiration,
+	// so that an aws.CredentialsCache retrieves them again and picks up rotations.
+	// If zero, DEFAULT_RETRIEVE_INTERVAL is used.
+	RetrieveInterval time.Duration
+}
+
+// NewCredentialsProvider returns a pointer to a CredentialsProvider for r.
+func NewCredentialsProvider(r roles.RolesReader) *CredentialsProvider {
+	p := new(CredentialsProvider)
+	p.Reader = r
+	p.RetrieveInterval = DEFAULT_RETRIEVE_INTERVAL
+	return p
+}
+
+// Retrieve returns the current credentials of the RolesReader. The session token is set if the
+// snapshot has one. CanExpire is set if the reader reports an expiration, or if it provides IAM
+// credentials that may be rotated out-of-band.
+func (p *CredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	if p.Reader == nil {
+		return aws.Credentials{}, errors.New("roles_awsv2.Retrieve: nil Reader")
+	}
+	// one snapshot, so the keys and expiration are from the same generation
+	snapshot, snapshot_err := roles.Snapshot(p.Reader)
+	if snapshot_err != nil {
+		e := fmt.Sprintf("roles_awsv2.Retrieve: %s: %s", p.Reader.ProviderType(), snapshot_err.Error())
+		return aws.Credentials{}, errors.New(e)
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     snapshot.AccessKey,
+		SecretAccessKey: snapshot.Secret,
+		Source:          "goawsroles:" + p.Reader.ProviderType(),
+	}
+	if snapshot.Token == "" {
+		return creds, nil
+	}
+	creds.SessionToken = snapshot.Token
+	if expiration, ok := snapshot.ExpiresAt(); ok {
+		creds.CanExpire = true
+		creds.Expires = expiration
+		return creds, nil
+	}
+	interval := p.RetrieveInterval
+	if interval <= 0 {
+		interval = DEFAULT_RETRIEVE_INTERVAL
+	}
+	creds.CanExpire = true
+	creds.Expires = time.Now().Add(interval)
+	return creds, nil
+}
+
+// RolesProvider is a RolesReader backed by an aws.CredentialsProvider.
+type RolesProvider struct {
+	Provider aws.CredentialsProvider
+	// Timeout bounds each call to Provider.Retrieve. If zero, DEFAULT_TIMEOUT is used.
+	Timeout time.Duration
+	// Refresher controls how far ahead of expiration RolesWatch retrieves new credentials.
+	Refresher roles.Refresher
+
+	fetch_lock sync.Mutex
+	roleFields *roles.RolesFields
+	lock       sync.RWMutex
+}
+
+// NewRolesProvider returns a pointer to a RolesProvider for p.
+func NewRolesProvider(p aws.CredentialsProvider) *RolesProvider {
+	r := new(RolesProvider)
+	r.Provider = p
+	r.Timeout = DEFAULT_TIMEOUT
+	r.roleFields = roles.NewRolesFields()
+	return r
+}
+
+// ProviderType is a descriptive string of the implementation.
+func (rf *RolesProvider) ProviderType() string {
+	return ROLE_PROVIDER
+}
+
+// UsingIAM tells us if the credentials provided by this role are temporary credentials which
+// also have a Token component, or if they are durable key/secret-only credentials. For this
+// package, that depends on whether the provider returned a SessionToken.
+func (rf *RolesProvider) UsingIAM() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.Token != ""
+}
+
+// IsEmpty determines if a RolesProvider struct is uninitialized. The SDK provider may not
+// return a SessionToken, so only the AccessKey and Secret are considered.
+func (rf *RolesProvider) IsEmpty() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.AccessKey == "" || rf.roleFields.Secret == ""
+}
+
+// ZeroRoles recreate the RolesProvider credentials as initialized by NewRolesProvider.
+func (rf *RolesProvider) ZeroRoles() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.lock.Unlock()
+}
+
+// RolesRead populates rolesFields with a blocking call to Provider.Retrieve.
+func (rf *RolesProvider) RolesRead() error {
+	roles_err := rf.rolesProviderRead()
+	if roles_err != nil {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. It retrieves from Provider like RolesRead, but on
+// failure the current credentials are kept.
+func (rf *RolesProvider) RolesReread() error {
+	return rf.rolesProviderRead()
+}
+
+// RolesWatch retrieves new credentials ahead of their expiration. See RolesWatchContext.
+func (rf *RolesProvider) RolesWatch(err_chan chan error, read_signal chan bool) {
+	rf.RolesWatchContext(context.Background(), err_chan, read_signal)
+}
+
+// RolesWatchContext retrieves new credentials ahead of their expiration, or every
+// Refresher.Interval if they cannot expire, until ctx is done. Each refresh is signalled on
+// read_signal. Failures are sent on err_chan and retried, leaving the current credentials in
+// place until they expire. ctx.Err() is the final value sent on err_chan.
+func (rf *RolesProvider) RolesWatchContext(ctx context.Context, err_chan chan error, read_signal chan bool) {
+	log.Printf("initiate roles watching\n")
+	rf.Refresher.Watch(ctx, err_chan, read_signal, rf.rolesProviderRead, rf.ExpiresAt)
+	log.Printf("terminating roles watching\n")
+}
+
+// ExpiresAt returns the expiration of the current credentials, and false if it is not known.
+func (rf *RolesProvider) ExpiresAt() (time.Time, bool) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.ExpiresAt()
+}
+
+// IsExpired reports whether the current credentials expire within skew of now.
+func (rf *RolesProvider) IsExpired(skew time.Duration) bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsExpired(skew)
+}
+
+// Get returns the (accessKey,secret,token), or an error. The token is empty if UsingIAM is false.
+func (rf *RolesProvider) Get() (string, string, string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	accessKey := ""
+	if rf.roleFields.AccessKey == "" {
+		return "", "", "", errors.New("roles_awsv2.Get: empty AccessKey")
+	} else {
+		accessKey = rf.roleFields.AccessKey
+	}
+	secret := ""
+	if rf.roleFields.Secret == "" {
+		return "", "", "", errors.New("roles_awsv2.Get: empty Secret")
+	} else {
+		secret = rf.roleFields.Secret
+	}
+	return accessKey, secret, rf.roleFields.Token, nil
+}
+
+// GetAccessKey returns the accessKey or an error.
+func (rf *RolesProvider) GetAccessKey() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.AccessKey == "" {
+		return "", errors.New("roles_awsv2.GetAccessKey: empty AccessKey")
+	} else {
+		return rf.roleFields.AccessKey, nil
+	}
+}
+
+// GetSecret returns the secret or an error.
+func (rf *RolesProvider) GetSecret() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Secret == "" {
+		return "", errors.New("roles_awsv2.GetSecret: empty Secret")
+	} else {
+		return rf.roleFields.Secret, nil
+	}
+}
+
+// GetToken returns the token or an error.
+func (rf *RolesProvider) GetToken() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Token == "" {
+		return "", errors.New("roles_awsv2.GetToken: empty Token")
+	} else {
+		return rf.roleFields.Token, nil
+	}
+}
+
+// will retrieve from the wrapped provider and swap the result in at once.
+func (rf *RolesProvider) rolesProviderRead() error {
+	rf.fetch_lock.Lock()
+	defer rf.fetch_lock.Unlock()
+	if rf.Provider == nil {
+		return errors.New("roles_awsv2.rolesProviderRead: nil Provider")
+	}
+	timeout := rf.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	creds, creds_err := rf.Provider.Retrieve(ctx)
+	if creds_err != nil {
+		e := fmt.Sprintf("roles_awsv2.rolesProviderRead: %s", creds_err.Error())
+		return errors.New(e)
+	}
+	if !creds.HasKeys() {
+		return errors.New("roles_awsv2.rolesProviderRead: provider returned no keys")
+	}
+	fields := roles.NewRolesFields()
+	fields.AccessKey = creds.AccessKeyID
+	fields.Secret = creds.SecretAccessKey
+	fields.Token = creds.SessionToken
+	if creds.CanExpire {
+		fields.Expiration = creds.Expires
+	}
+	rf.lock.Lock()
+	*rf.roleFields = *fields
+	rf.lock.Unlock()
+	log.Printf("roles_awsv2.rolesProviderRead: succesful assignment of role data\n")
+	return nil
+}
@@ -0,0 +1,114 @@
+package roles_awsv2
+
+import (
+	"context"
+	aws "github.com/aws/aws-sdk-go-v2/aws"
+	roles "github.com/smugmug/goawsroles/roles"
+	roles_env "github.com/smugmug/goawsroles/roles_env"
+	roles_master "github.com/smugmug/goawsroles/roles_master"
+	roles_simple "github.com/smugmug/goawsroles/roles_simple"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCredentialsProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour)
+	rs := roles_simple.NewRolesSimpleWithExpiration("key", "secret", "token", expiration)
+	creds, creds_err := NewCredentialsProvider(rs).Retrieve(context.Background())
+	if creds_err != nil {
+		t.Fatal(creds_err.Error())
+	}
+	if creds.AccessKeyID != "key" || creds.SecretAccessKey != "secret" || creds.SessionToken != "token" {
+		t.Errorf("unexpected credentials: %+v", creds)
+	}
+	if !creds.CanExpire || !creds.Expires.Equal(expiration) {
+		t.Errorf("expected expiration %v, got %v %v", expiration, creds.CanExpire, creds.Expires)
+	}
+
+	// durable credentials never expire and carry no token
+	rm := roles_master.NewRolesMaster("masterkey", "mastersecret")
+	creds, creds_err = NewCredentialsProvider(rm).Retrieve(context.Background())
+	if creds_err != nil {
+		t.Fatal(creds_err.Error())
+	}
+	if creds.CanExpire || creds.SessionToken != "" {
+		t.Errorf("master credentials should not expire: %+v", creds)
+	}
+
+	// IAM credentials with an unknown expiration are retrieved again after RetrieveInterval
+	p := NewCredentialsProvider(roles_simple.NewRolesSimple("key", "secret", "token"))
+	p.RetrieveInterval = time.Second
+	creds, creds_err = p.Retrieve(context.Background())
+	if creds_err != nil {
+		t.Fatal(creds_err.Error())
+	}
+	if !creds.CanExpire || creds.Expires.After(time.Now().Add(2*time.Second)) {
+		t.Errorf("expected a short expiration: %+v", creds)
+	}
+
+	rs.ZeroRoles()
+	if _, creds_err = NewCredentialsProvider(rs).Retrieve(context.Background()); creds_err == nil {
+		t.Errorf("expected an error from an empty reader")
+	}
+}
+
+func TestCredentialsProviderCache(t *testing.T) {
+	os.Setenv("TEST_AWSV2_"+roles_env.ACCESS_KEY_ENV, "key1")
+	os.Setenv("TEST_AWSV2_"+roles_env.SECRET_ENV, "secret")
+	os.Setenv("TEST_AWSV2_"+roles_env.TOKEN_ENV, "token")
+	defer os.Unsetenv("TEST_AWSV2_" + roles_env.ACCESS_KEY_ENV)
+	defer os.Unsetenv("TEST_AWSV2_" + roles_env.SECRET_ENV)
+	defer os.Unsetenv("TEST_AWSV2_" + roles_env.TOKEN_ENV)
+	re := roles_env.NewRolesEnvPrefix("TEST_AWSV2_")
+	if rr_err := re.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+
+	p := NewCredentialsProvider(re)
+	p.RetrieveInterval = 10 * time.Millisecond
+	cache := aws.NewCredentialsCache(p)
+	creds, _ := cache.Retrieve(context.Background())
+	if creds.AccessKeyID != "key1" {
+		t.Errorf("unexpected cached key: %s", creds.AccessKeyID)
+	}
+
+	// a rotation in the reader reaches the SDK cache once RetrieveInterval passes
+	os.Setenv("TEST_AWSV2_"+roles_env.ACCESS_KEY_ENV, "key2")
+	if rr_err := re.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+	creds, _ = cache.Retrieve(context.Background())
+	if creds.AccessKeyID != "key2" {
+		t.Errorf("cache did not pick up the rotated key: %s", creds.AccessKeyID)
+	}
+}
+
+func TestRolesProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour)
+	sdk := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{
+			AccessKeyID:     "sdkkey",
+			SecretAccessKey: "sdksecret",
+			SessionToken:    "sdktoken",
+			CanExpire:       true,
+			Expires:         expiration,
+		}, nil
+	})
+	rp := NewRolesProvider(sdk)
+	rr_err := roles.RolesReader(rp).RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, token, get_err := rp.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "sdkkey" || secret != "sdksecret" || token != "sdktoken" || !rp.UsingIAM() {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+	if got, ok := rp.ExpiresAt(); !ok || !got.Equal(expiration) {
+		t.Errorf("expected expiration %v, got %v", expiration, got)
+	}
+}
@@ -0,0 +1,253 @@
+// Implements the RolesReader interface (roles.go) over an ordered list of other RolesReaders.
+// The first provider that reads successfully and is not empty becomes the active provider,
+// so the same program can use local files on one host and hardcoded credentials on another.
+//
+package roles_chain
+
+import (
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "chain"
+)
+
+// ChainProvider tries each of its providers in order and delegates to the first usable one.
+type ChainProvider struct {
+	providers []roles.RolesReader
+	active    int
+	lock      sync.RWMutex
+	// select_lock serializes selecting a provider. It is held while providers are read, which
+	// may block on the network, so lock is only taken to swap active.
+	select_lock sync.Mutex
+}
+
+// NewChainProvider returns a pointer to a ChainProvider over providers, in order of preference.
+// No provider is active until RolesRead is called.
+func NewChainProvider(providers ...roles.RolesReader) *ChainProvider {
+	r := new(ChainProvider)
+	r.providers = providers
+	r.active = -1
+	return r
+}
+
+// Active returns the provider currently in use, or nil if there is none.
+func (rc *ChainProvider) Active() roles.RolesReader {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	return rc.activeProvider()
+}
+
+// activeProvider must be called with the lock held.
+func (rc *ChainProvider) activeProvider() roles.RolesReader {
+	if rc.active < 0 || rc.active >= len(rc.providers) {
+		return nil
+	}
+	return rc.providers[rc.active]
+}
+
+// ProviderType is a descriptive string of the implementation, followed by the ProviderType of
+// the active provider if there is one, e.g. "chain:file".
+func (rc *ChainProvider) ProviderType() string {
+	active := rc.Active()
+	if active == nil {
+		return ROLE_PROVIDER
+	}
+	return ROLE_PROVIDER + ":" + active.ProviderType()
+}
+
+// UsingIAM reports UsingIAM of the active provider, or false if there is none.
+func (rc *ChainProvider) UsingIAM() bool {
+	active := rc.Active()
+	if active == nil {
+		return false
+	}
+	return active.UsingIAM()
+}
+
+// IsEmpty is true if there is no active provider or the active provider is empty.
+func (rc *ChainProvider) IsEmpty() bool {
+	active := rc.Active()
+	return active == nil || active.IsEmpty()
+}
+
+// ZeroRoles zeroes every provider in the chain and deselects the active provider.
+func (rc *ChainProvider) ZeroRoles() {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for _, p := range rc.providers {
+		p.ZeroRoles()
+	}
+	rc.active = -1
+}
+
+// RolesRead selects the first provider whose RolesRead succeeds and which is not empty.
+// If no provider qualifies, the error lists why each one was skipped.
+func (rc *ChainProvider) RolesRead() error {
+	rc.select_lock.Lock()
+	defer rc.select_lock.Unlock()
+	active, select_err := rc.selectFrom(0)
+	rc.lock.Lock()
+	rc.active = active
+	rc.lock.Unlock()
+	return select_err
+}
+
+// RolesReread implements roles.RolesRereader by forwarding to the active provider. If there is no
+// active provider, or it does not implement roles.RolesRereader, an error is returned and nothing
+// is read.
+func (rc *ChainProvider) RolesReread() error {
+	active := rc.Active()
+	if active == nil {
+		return errors.New("roles_chain.RolesReread: no active provider")
+	}
+	rr, ok := active.(roles.RolesRereader)
+	if !ok {
+		e := fmt.Sprintf("roles_chain.RolesReread: %s does not implement RolesReread", active.ProviderType())
+		return errors.New(e)
+	}
+	return rr.RolesReread()
+}
+
+// selectFrom returns the index of the first usable provider at or after index start, or -1
+// and an error. It must be called with select_lock held, and without lock.
+func (rc *ChainProvider) selectFrom(start int) (int, error) {
+	if len(rc.providers) == 0 {
+		return -1, errors.New("roles_chain.RolesRead: no providers in chain")
+	}
+	errs := make([]string, 0)
+	for i := start; i < len(rc.providers); i++ {
+		p := rc.providers[i]
+		read_err := p.RolesRead()
+		if read_err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", p.ProviderType(), read_err.Error()))
+			continue
+		}
+		if p.IsEmpty() {
+			errs = append(errs, fmt.Sprintf("%s: empty", p.ProviderType()))
+			continue
+		}
+		return i, nil
+	}
+	e := fmt.Sprintf("roles_chain.RolesRead: no usable provider: %s", strings.Join(errs, "; "))
+	return -1, errors.New(e)
+}
+
+// RolesWatch delegates to the RolesWatch of the active provider. Providers that do not
+// support watching panic; that panic is recovered here and reported on err_chan.
+// If Get later falls through to another provider, the watch is not moved to it.
+func (rc *ChainProvider) RolesWatch(err_chan chan error, read_signal chan bool) {
+	active := rc.Active()
+	if active == nil {
+		err_chan <- errors.New("roles_chain.RolesWatch: no active provider")
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			e := fmt.Sprintf("roles_chain.RolesWatch: %s: %v", active.ProviderType(), r)
+			err_chan <- errors.New(e)
+		}
+	}()
+	active.RolesWatch(err_chan, read_signal)
+}
+
+// ExpiresAt returns the expiration of the active provider's credentials, if it is known.
+func (rc *ChainProvider) ExpiresAt() (time.Time, bool) {
+	active := rc.Active()
+	if active == nil {
+		return time.Time{}, false
+	}
+	return roles.ExpiresAt(active)
+}
+
+// IsExpired reports whether the active provider's credentials expire within skew of now.
+func (rc *ChainProvider) IsExpired(skew time.Duration) bool {
+	active := rc.Active()
+	if active == nil {
+		return false
+	}
+	return roles.IsExpired(active, skew)
+}
+
+// Credentials returns a snapshot of the active provider's credentials. See roles.Snapshot.
+func (rc *ChainProvider) Credentials() (*roles.Credentials, error) {
+	active := rc.Active()
+	if active == nil {
+		return nil, errors.New("roles_chain.Credentials: no active provider")
+	}
+	return roles.Snapshot(active)
+}
+
+// Get returns the (accessKey,secret,token) of the active provider, or an error.
+// If the active provider returns an error, the providers after it in the chain are tried
+// in order and the first that reads and returns credentials becomes the active provider.
+func (rc *ChainProvider) Get() (string, string, string, error) {
+	rc.lock.RLock()
+	active, active_i := rc.activeProvider(), rc.active
+	rc.lock.RUnlock()
+	if active == nil {
+		return "", "", "", errors.New("roles_chain.Get: no active provider")
+	}
+	accessKey, secret, token, get_err := active.Get()
+	if get_err == nil {
+		return accessKey, secret, token, nil
+	}
+
+	rc.select_lock.Lock()
+	defer rc.select_lock.Unlock()
+	// another caller may have already fallen through
+	rc.lock.RLock()
+	current, current_i := rc.activeProvider(), rc.active
+	rc.lock.RUnlock()
+	if current_i != active_i && current != nil {
+		return current.Get()
+	}
+	for start := active_i + 1; start < len(rc.providers); {
+		next_i, select_err := rc.selectFrom(start)
+		if select_err != nil {
+			break
+		}
+		accessKey, secret, token, next_err := rc.providers[next_i].Get()
+		if next_err == nil {
+			rc.lock.Lock()
+			rc.active = next_i
+			rc.lock.Unlock()
+			return accessKey, secret, token, nil
+		}
+		start = next_i + 1
+	}
+	e := fmt.Sprintf("roles_chain.Get: %s: %s", active.ProviderType(), get_err.Error())
+	return "", "", "", errors.New(e)
+}
+
+// GetAccessKey returns the accessKey of the active provider or an error.
+func (rc *ChainProvider) GetAccessKey() (string, error) {
+	active := rc.Active()
+	if active == nil {
+		return "", errors.New("roles_chain.GetAccessKey: no active provider")
+	}
+	return active.GetAccessKey()
+}
+
+// GetSecret returns the secret of the active provider or an error.
+func (rc *ChainProvider) GetSecret() (string, error) {
+	active := rc.Active()
+	if active == nil {
+		return "", errors.New("roles_chain.GetSecret: no active provider")
+	}
+	return active.GetSecret()
+}
+
+// GetToken returns the token of the active provider or an error.
+func (rc *ChainProvider) GetToken() (string, error) {
+	active := rc.Active()
+	if active == nil {
+		return "", errors.New("roles_chain.GetToken: no active provider")
+	}
+	return active.GetToken()
+}
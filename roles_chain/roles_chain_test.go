@@ -0,0 +1,174 @@
+package roles_chain
+
+import (
+	roles "github.com/smugmug/goawsroles/roles"
+	roles_env "github.com/smugmug/goawsroles/roles_env"
+	roles_files "github.com/smugmug/goawsroles/roles_files"
+	roles_master "github.com/smugmug/goawsroles/roles_master"
+	roles_simple "github.com/smugmug/goawsroles/roles_simple"
+	"os"
+	"testing"
+	"time"
+)
+
+// slow_reader blocks in RolesRead until release is closed.
+type slow_reader struct {
+	*roles_simple.RolesSimple
+	entered chan bool
+	release chan bool
+}
+
+func (s *slow_reader) RolesRead() error {
+	s.entered <- true
+	<-s.release
+	return s.RolesSimple.RolesRead()
+}
+
+func TestChainProvider(t *testing.T) {
+	missing := roles_files.NewRolesFiles()
+	missing.BaseDir = "./test_files_not_there"
+	missing.AccessKeyFile = "role_access_key"
+	missing.SecretFile = "role_secret_key"
+	missing.TokenFile = "role_token"
+
+	c := NewChainProvider(missing, roles_master.NewRolesMaster("masterkey", "mastersecret"))
+	if !c.IsEmpty() {
+		t.Errorf("new ChainProvider is not empty?")
+	}
+	if c.ProviderType() != ROLE_PROVIDER {
+		t.Errorf("unexpected provider type before read: %s", c.ProviderType())
+	}
+	rc := roles.RolesReader(c)
+	rr_err := rc.RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	if rc.ProviderType() != "chain:master" {
+		t.Errorf("unexpected provider type: %s", rc.ProviderType())
+	}
+	if rc.UsingIAM() {
+		t.Errorf("master credentials should not be IAM")
+	}
+	accessKey, secret, _, get_err := rc.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "masterkey" || secret != "mastersecret" {
+		t.Errorf("unexpected credentials: %s %s", accessKey, secret)
+	}
+}
+
+func TestChainProviderFallThrough(t *testing.T) {
+	first := roles_simple.NewRolesSimple("key1", "secret1", "token1")
+	second := roles_simple.NewRolesSimple("key2", "secret2", "token2")
+	c := NewChainProvider(first, second)
+	rr_err := c.RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, _, _, get_err := c.Get()
+	if get_err != nil || accessKey != "key1" {
+		t.Errorf("expected key1 from first provider, got %s %v", accessKey, get_err)
+	}
+
+	// the active provider starts failing, so Get should move on to the next one
+	first.ZeroRoles()
+	accessKey, _, _, get_err = c.Get()
+	if get_err != nil || accessKey != "key2" {
+		t.Errorf("expected key2 from second provider, got %s %v", accessKey, get_err)
+	}
+	if c.Active() != roles.RolesReader(second) {
+		t.Errorf("second provider should now be active")
+	}
+
+	second.ZeroRoles()
+	_, _, _, get_err = c.Get()
+	if get_err == nil {
+		t.Errorf("expected an error with every provider zeroed")
+	}
+}
+
+func TestChainProviderNoneUsable(t *testing.T) {
+	c := NewChainProvider(roles_simple.NewRolesSimple("", "", ""))
+	if c.RolesRead() == nil {
+		t.Errorf("expected an error when no provider is usable")
+	}
+	if !c.IsEmpty() {
+		t.Errorf("chain with no usable provider is not empty?")
+	}
+}
+
+func TestChainProviderReread(t *testing.T) {
+	os.Setenv("TEST_CHAIN_"+roles_env.ACCESS_KEY_ENV, "envkey1")
+	os.Setenv("TEST_CHAIN_"+roles_env.SECRET_ENV, "envsecret")
+	defer os.Unsetenv("TEST_CHAIN_" + roles_env.ACCESS_KEY_ENV)
+	defer os.Unsetenv("TEST_CHAIN_" + roles_env.SECRET_ENV)
+
+	c := NewChainProvider(roles_env.NewRolesEnvPrefix("TEST_CHAIN_"), roles_master.NewRolesMaster("masterkey", "mastersecret"))
+	if c.RolesReread() == nil {
+		t.Errorf("expected an error rereading with no active provider")
+	}
+	if rr_err := c.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	os.Setenv("TEST_CHAIN_"+roles_env.ACCESS_KEY_ENV, "envkey2")
+	if rr_err := c.RolesReread(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	if accessKey, _ := c.GetAccessKey(); accessKey != "envkey2" {
+		t.Errorf("RolesReread was not forwarded: %s", accessKey)
+	}
+	// a failed reread keeps the credentials and the active provider
+	os.Unsetenv("TEST_CHAIN_" + roles_env.ACCESS_KEY_ENV)
+	if c.RolesReread() == nil {
+		t.Errorf("expected an error rereading an unset environment")
+	}
+	if accessKey, _ := c.GetAccessKey(); accessKey != "envkey2" || c.ProviderType() != "chain:env" {
+		t.Errorf("the credentials were not kept: %s %s", accessKey, c.ProviderType())
+	}
+
+	m := NewChainProvider(roles_master.NewRolesMaster("masterkey", "mastersecret"))
+	m.RolesRead()
+	if m.RolesReread() == nil {
+		t.Errorf("expected an error rereading a provider without RolesReread")
+	}
+}
+
+func TestChainProviderFallThroughUnlocked(t *testing.T) {
+	first := roles_master.NewRolesMaster("masterkey", "mastersecret")
+	second := &slow_reader{
+		RolesSimple: roles_simple.NewRolesSimple("key2", "secret2", "token2"),
+		entered:     make(chan bool, 1),
+		release:     make(chan bool),
+	}
+	c := NewChainProvider(first, second)
+	if rr_err := c.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	first.ZeroRoles()
+	got := make(chan string, 1)
+	go func() {
+		accessKey, _, _, _ := c.Get()
+		got <- accessKey
+	}()
+	<-second.entered
+
+	// reading the next provider must not block callers of the active one
+	done := make(chan string, 1)
+	go func() { done <- c.ProviderType() }()
+	select {
+	case provider := <-done:
+		if provider != "chain:master" {
+			t.Errorf("unexpected provider type during fallthrough: %s", provider)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProviderType blocked while the next provider was read")
+	}
+	close(second.release)
+	if accessKey := <-got; accessKey != "key2" {
+		t.Errorf("expected key2 from second provider, got %s", accessKey)
+	}
+	if c.ProviderType() != "chain:simple" {
+		t.Errorf("second provider should now be active: %s", c.ProviderType())
+	}
+}
@@ -0,0 +1,327 @@
+// Implements the RolesReader interface (roles.go) for the container credentials endpoint used by
+// ECS tasks and EKS Pod Identity. The endpoint is located through the
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI environment
+// variables set by the container agent.
+//
+package roles_ecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "ecs"
+
+	RELATIVE_URI_ENV    = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+	FULL_URI_ENV        = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	AUTH_TOKEN_ENV      = "AWS_CONTAINER_AUTHORIZATION_TOKEN"
+	AUTH_TOKEN_FILE_ENV = "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"
+
+	// DEFAULT_ENDPOINT is the host that RelativeURI is resolved against.
+	DEFAULT_ENDPOINT = "http://169.254.170.2"
+	// DEFAULT_TIMEOUT bounds each request to the credentials endpoint.
+	DEFAULT_TIMEOUT = 5 * time.Second
+)
+
+// container_hosts are the non-loopback addresses a plain http FullURI may point at:
+// the ECS agent and the EKS Pod Identity agent.
+var container_hosts = []string{"169.254.170.2", "169.254.170.23", "fd00:ec2::23"}
+
+// RolesECS fetches credentials from the container credentials endpoint.
+type RolesECS struct {
+	// RelativeURI is a path on Endpoint, as found in AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+	// It takes precedence over FullURI.
+	RelativeURI string
+	// FullURI is a complete URL, as found in AWS_CONTAINER_CREDENTIALS_FULL_URI. It must use
+	// https, or point at a loopback or container agent address.
+	FullURI string
+	// AuthToken is sent as the Authorization header, as found in AWS_CONTAINER_AUTHORIZATION_TOKEN.
+	AuthToken string
+	// AuthTokenFile names a file holding the Authorization header, as found in
+	// AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE. It is re-read on every fetch and takes
+	// precedence over AuthToken.
+	AuthTokenFile string
+	// Endpoint is the base URL for RelativeURI. If empty, DEFAULT_ENDPOINT is used.
+	Endpoint string
+	// Client is used for requests to the credentials endpoint.
+	Client *http.Client
+	// Refresher controls how far ahead of Expiration RolesWatch fetches new credentials.
+	Refresher roles.Refresher
+
+	fetch_lock sync.Mutex
+	roleFields *roles.RolesFields
+	lock       sync.RWMutex
+}
+
+// NewRolesECS returns a pointer to a RolesECS instance configured from the environment.
+func NewRolesECS() *RolesECS {
+	r := new(RolesECS)
+	r.RelativeURI = os.Getenv(RELATIVE_URI_ENV)
+	r.FullURI = os.Getenv(FULL_URI_ENV)
+	r.AuthToken = os.Getenv(AUTH_TOKEN_ENV)
+	r.AuthTokenFile = os.Getenv(AUTH_TOKEN_FILE_ENV)
+	r.Client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	r.roleFields = roles.NewRolesFields()
+	return r
+}
+
+// ProviderType is a descriptive string of the implementation.
+func (rf *RolesECS) ProviderType() string {
+	return ROLE_PROVIDER
+}
+
+// UsingIAM tells us if the credentials provided by this role are temporary credentials which
+// also have a Token component, or if they are durable key/secret-only credentials.
+func (rf *RolesECS) UsingIAM() bool {
+	return true
+}
+
+// IsEmpty determines if a RolesECS struct is uninitialized.
+func (rf *RolesECS) IsEmpty() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsEmpty()
+}
+
+// ZeroRoles recreate the RolesECS credentials as initialized by NewRolesECS.
+func (rf *RolesECS) ZeroRoles() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.lock.Unlock()
+}
+
+// RolesRead populates rolesFields with a blocking fetch from the credentials endpoint.
+func (rf *RolesECS) RolesRead() error {
+	roles_err := rf.rolesECSRead()
+	if roles_err != nil {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. It fetches from the container credentials endpoint
+// like RolesRead, but on failure the current credentials are kept.
+func (rf *RolesECS) RolesReread() error {
+	return rf.rolesECSRead()
+}
+
+// RolesWatch fetches new credentials ahead of their Expiration. See RolesWatchContext.
+func (rf *RolesECS) RolesWatch(err_chan chan error, read_signal chan bool) {
+	rf.RolesWatchContext(context.Background(), err_chan, read_signal)
+}
+
+// RolesWatchContext fetches new credentials ahead of their Expiration until ctx is done,
+// signalling each refresh on read_signal. Failed fetches are sent on err_chan and retried,
+// leaving the current credentials in place until they expire. ctx.Err() is the final value
+// sent on err_chan.
+func (rf *RolesECS) RolesWatchContext(ctx context.Context, err_chan chan error, read_signal chan bool) {
+	log.Printf("initiate roles watching\n")
+	rf.Refresher.Watch(ctx, err_chan, read_signal, rf.rolesECSRead, rf.ExpiresAt)
+	log.Printf("terminating roles watching\n")
+}
+
+// ExpiresAt returns the expiration of the current credentials, and false if it is not known.
+func (rf *RolesECS) ExpiresAt() (time.Time, bool) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.ExpiresAt()
+}
+
+// IsExpired reports whether the current credentials expire within skew of now.
+func (rf *RolesECS) IsExpired(skew time.Duration) bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsExpired(skew)
+}
+
+// Get returns the (accessKey,secret,token), or an error.
+func (rf *RolesECS) Get() (string, string, string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	accessKey := ""
+	if rf.roleFields.AccessKey == "" {
+		return "", "", "", errors.New("roles_ecs.Get: empty AccessKey")
+	} else {
+		accessKey = rf.roleFields.AccessKey
+	}
+	secret := ""
+	if rf.roleFields.Secret == "" {
+		return "", "", "", errors.New("roles_ecs.Get: empty Secret")
+	} else {
+		secret = rf.roleFields.Secret
+	}
+	token := ""
+	if rf.roleFields.Token == "" {
+		return "", "", "", errors.New("roles_ecs.Get: empty Token")
+	} else {
+		token = rf.roleFields.Token
+	}
+	return accessKey, secret, token, nil
+}
+
+// GetAccessKey returns the accessKey or an error.
+func (rf *RolesECS) GetAccessKey() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.AccessKey == "" {
+		return "", errors.New("roles_ecs.GetAccessKey: empty AccessKey")
+	} else {
+		return rf.roleFields.AccessKey, nil
+	}
+}
+
+// GetSecret returns the secret or an error.
+func (rf *RolesECS) GetSecret() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Secret == "" {
+		return "", errors.New("roles_ecs.GetSecret: empty Secret")
+	} else {
+		return rf.roleFields.Secret, nil
+	}
+}
+
+// GetToken returns the token or an error.
+func (rf *RolesECS) GetToken() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Token == "" {
+		return "", errors.New("roles_ecs.GetToken: empty Token")
+	} else {
+		return rf.roleFields.Token, nil
+	}
+}
+
+// credentials_url resolves RelativeURI or FullURI to the URL to fetch.
+func (rf *RolesECS) credentials_url() (string, error) {
+	if rf.RelativeURI != "" {
+		endpoint := rf.Endpoint
+		if endpoint == "" {
+			endpoint = DEFAULT_ENDPOINT
+		}
+		return strings.TrimRight(endpoint, "/") + "/" + strings.TrimLeft(rf.RelativeURI, "/"), nil
+	}
+	if rf.FullURI == "" {
+		e := fmt.Sprintf("roles_ecs.credentials_url: neither %s nor %s is set",
+			RELATIVE_URI_ENV, FULL_URI_ENV)
+		return "", errors.New(e)
+	}
+	u, u_err := url.Parse(rf.FullURI)
+	if u_err != nil {
+		e := fmt.Sprintf("roles_ecs.credentials_url: bad FullURI: %s", u_err.Error())
+		return "", errors.New(e)
+	}
+	if !valid_full_uri(u) {
+		e := fmt.Sprintf("roles_ecs.credentials_url: FullURI host %s must be loopback, "+
+			"a container agent address, or use https", u.Hostname())
+		return "", errors.New(e)
+	}
+	return u.String(), nil
+}
+
+// valid_full_uri applies the same restrictions as the AWS SDKs: https anywhere, or plain http
+// only to loopback addresses and the container agents.
+func valid_full_uri(u *url.URL) bool {
+	if u.Scheme == "https" {
+		return true
+	}
+	if u.Scheme != "http" {
+		return false
+	}
+	host := u.Hostname()
+	for _, h := range container_hosts {
+		if host == h {
+			return true
+		}
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// auth_token returns the Authorization header value, preferring AuthTokenFile.
+func (rf *RolesECS) auth_token() (string, error) {
+	if rf.AuthTokenFile == "" {
+		return rf.AuthToken, nil
+	}
+	b, b_err := ioutil.ReadFile(rf.AuthTokenFile)
+	if b_err != nil {
+		e := fmt.Sprintf("roles_ecs.auth_token: %s read err: %s", rf.AuthTokenFile, b_err.Error())
+		return "", errors.New(e)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		e := fmt.Sprintf("roles_ecs.auth_token: %s is empty", rf.AuthTokenFile)
+		return "", errors.New(e)
+	}
+	return token, nil
+}
+
+// will fetch the credentials document and swap it in at once.
+// readers are only blocked for the swap, not for the request.
+func (rf *RolesECS) rolesECSRead() error {
+	rf.fetch_lock.Lock()
+	defer rf.fetch_lock.Unlock()
+	creds_url, url_err := rf.credentials_url()
+	if url_err != nil {
+		return url_err
+	}
+	token, token_err := rf.auth_token()
+	if token_err != nil {
+		return token_err
+	}
+	req, req_err := http.NewRequest("GET", creds_url, nil)
+	if req_err != nil {
+		return req_err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	client := rf.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, resp_err := client.Do(req)
+	if resp_err != nil {
+		e := fmt.Sprintf("roles_ecs.rolesECSRead: %s", resp_err.Error())
+		return errors.New(e)
+	}
+	defer resp.Body.Close()
+	body, body_err := ioutil.ReadAll(resp.Body)
+	if body_err != nil {
+		e := fmt.Sprintf("roles_ecs.rolesECSRead: read err: %s", body_err.Error())
+		return errors.New(e)
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := fmt.Sprintf("roles_ecs.rolesECSRead: status %d", resp.StatusCode)
+		return errors.New(e)
+	}
+	fields, parse_err := roles.ParseRolesJSON(body)
+	if parse_err != nil {
+		e := fmt.Sprintf("roles_ecs.rolesECSRead: %s", parse_err.Error())
+		return errors.New(e)
+	}
+	if fields.Token == "" {
+		return errors.New("roles_ecs.rolesECSRead: empty Token")
+	}
+	rf.lock.Lock()
+	*rf.roleFields = *fields
+	rf.lock.Unlock()
+	log.Printf("roles_ecs.rolesECSRead: succesful assignment of role data\n")
+	return nil
+}
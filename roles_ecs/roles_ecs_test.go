@@ -0,0 +1,105 @@
+package roles_ecs
+
+import (
+	"encoding/json"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func fake_ecs(auth string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/credentials/test" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != auth {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(roles.RolesJSON{
+			AccessKeyId:     "accesskey",
+			SecretAccessKey: "secretkey",
+			Token:           "token",
+			Expiration:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+	}))
+}
+
+func TestRolesECSRelative(t *testing.T) {
+	ts := fake_ecs("")
+	defer ts.Close()
+
+	re := NewRolesECS()
+	re.Endpoint = ts.URL
+	re.RelativeURI = "/v2/credentials/test"
+	rr_err := roles.RolesReader(re).RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, token, get_err := re.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "accesskey" || secret != "secretkey" || token != "token" {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+	if _, ok := re.ExpiresAt(); !ok {
+		t.Errorf("expected a known expiration")
+	}
+}
+
+func TestRolesECSFullURIAuthFile(t *testing.T) {
+	ts := fake_ecs("secret-auth")
+	defer ts.Close()
+
+	dir, dir_err := ioutil.TempDir("", "roles_ecs")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	auth_file := filepath.Join(dir, "token")
+	if write_err := ioutil.WriteFile(auth_file, []byte("secret-auth\n"), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+
+	re := NewRolesECS()
+	re.RelativeURI = ""
+	re.FullURI = ts.URL + "/v2/credentials/test"
+	re.AuthToken = "ignored"
+	re.AuthTokenFile = auth_file
+	rr_err := re.RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+
+	re.AuthTokenFile = ""
+	if re.RolesRead() == nil {
+		t.Errorf("expected an error with the wrong authorization token")
+	}
+}
+
+func TestRolesECSFullURIHosts(t *testing.T) {
+	for u, valid := range map[string]bool{
+		"http://127.0.0.1:8080/creds":     true,
+		"http://localhost/creds":          true,
+		"http://169.254.170.23/v1/creds":  true,
+		"https://creds.example.com/creds": true,
+		"http://creds.example.com/creds":  false,
+		"ftp://127.0.0.1/creds":           false,
+	} {
+		parsed, parse_err := url.Parse(u)
+		if parse_err != nil {
+			t.Fatal(parse_err.Error())
+		}
+		if valid_full_uri(parsed) != valid {
+			t.Errorf("valid_full_uri(%s) should be %v", u, valid)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Implements the RolesReader interface (roles.go) for credentials held in environment variables:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or the legacy AWS_ACCESS_KEY
+// and AWS_SECRET_KEY. A Prefix can be set so one process can hold several sets of credentials,
+// e.g. a Prefix of "BACKUP_" reads BACKUP_AWS_ACCESS_KEY_ID.
+//
+package roles_env
+
+import (
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "env"
+
+	ACCESS_KEY_ENV    = "AWS_ACCESS_KEY_ID"
+	SECRET_ENV        = "AWS_SECRET_ACCESS_KEY"
+	TOKEN_ENV         = "AWS_SESSION_TOKEN"
+	LEGACY_ACCESS_ENV = "AWS_ACCESS_KEY"
+	LEGACY_SECRET_ENV = "AWS_SECRET_KEY"
+)
+
+// RolesEnv is populated from the environment on each RolesRead.
+type RolesEnv struct {
+	// Prefix is prepended to each environment variable name.
+	Prefix     string
+	roleFields *roles.RolesFields
+	lock       sync.RWMutex
+}
+
+// NewRolesEnv returns a pointer to a RolesEnv instance reading the unprefixed variables.
+func NewRolesEnv() *RolesEnv {
+	return NewRolesEnvPrefix("")
+}
+
+// NewRolesEnvPrefix returns a pointer to a RolesEnv instance reading variables named with prefix.
+func NewRolesEnvPrefix(prefix string) *RolesEnv {
+	r := new(RolesEnv)
+	r.Prefix = prefix
+	r.roleFields = roles.NewRolesFields()
+	return r
+}
+
+// ProviderType is a descriptive string of the implementation.
+func (rf *RolesEnv) ProviderType() string {
+	return ROLE_PROVIDER
+}
+
+// UsingIAM tells us if the credentials provided by this role are temporary credentials which
+// also have a Token component, or if they are durable key/secret-only credentials. For this
+// package, that depends on whether a session token was found in the environment.
+func (rf *RolesEnv) UsingIAM() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.Token != ""
+}
+
+// IsEmpty determines if a RolesEnv struct is uninitialized. The session token is optional,
+// so only the AccessKey and Secret are considered.
+func (rf *RolesEnv) IsEmpty() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.AccessKey == "" || rf.roleFields.Secret == ""
+}
+
+// ZeroRoles recreate the RolesEnv as initialized by NewRolesEnvPrefix.
+func (rf *RolesEnv) ZeroRoles() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.lock.Unlock()
+}
+
+// RolesRead populates rolesFields by re-reading the environment.
+func (rf *RolesEnv) RolesRead() error {
+	roles_err := rf.rolesEnvRead()
+	if roles_err != nil {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. It reads the environment like RolesRead, but on
+// failure the current credentials are kept.
+func (rf *RolesEnv) RolesReread() error {
+	return rf.rolesEnvRead()
+}
+
+// RolesWatch will panic on this implementation as the environment of a process is not
+// changed out-of-band. Call RolesRead to pick up changes made with os.Setenv.
+func (rf *RolesEnv) RolesWatch(err_chan chan error, read_signal chan bool) {
+	panic("RolesWatch not defined for RolesEnv; call RolesRead to re-read the environment")
+}
+
+// ExpiresAt always returns false as the environment carries no expiration.
+func (rf *RolesEnv) ExpiresAt() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// IsExpired always returns false as the environment carries no expiration.
+func (rf *RolesEnv) IsExpired(skew time.Duration) bool {
+	return false
+}
+
+// Get returns the (accessKey,secret,token), or an error. The token is empty if UsingIAM is false.
+func (rf *RolesEnv) Get() (string, string, string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	accessKey := ""
+	if rf.roleFields.AccessKey == "" {
+		return "", "", "", errors.New("roles_env.Get: empty AccessKey")
+	} else {
+		accessKey = rf.roleFields.AccessKey
+	}
+	secret := ""
+	if rf.roleFields.Secret == "" {
+		return "", "", "", errors.New("roles_env.Get: empty Secret")
+	} else {
+		secret = rf.roleFields.Secret
+	}
+	return accessKey, secret, rf.roleFields.Token, nil
+}
+
+// GetAccessKey returns the accessKey or an error.
+func (rf *RolesEnv) GetAccessKey() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.AccessKey == "" {
+		return "", errors.New("roles_env.GetAccessKey: empty AccessKey")
+	} else {
+		return rf.roleFields.AccessKey, nil
+	}
+}
+
+// GetSecret returns the secret or an error.
+func (rf *RolesEnv) GetSecret() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Secret == "" {
+		return "", errors.New("roles_env.GetSecret: empty Secret")
+	} else {
+		return rf.roleFields.Secret, nil
+	}
+}
+
+// GetToken returns the token or an error.
+func (rf *RolesEnv) GetToken() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Token == "" {
+		return "", errors.New("roles_env.GetToken: empty Token")
+	} else {
+		return rf.roleFields.Token, nil
+	}
+}
+
+// getenv returns the first non-empty prefixed variable among names.
+func (rf *RolesEnv) getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(rf.Prefix + name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// will read in the variables and swap them in at once.
+func (rf *RolesEnv) rolesEnvRead() error {
+	accessKey := rf.getenv(ACCESS_KEY_ENV, LEGACY_ACCESS_ENV)
+	if accessKey == "" {
+		e := fmt.Sprintf("roles_env.rolesEnvRead: neither %s%s nor %s%s is set",
+			rf.Prefix, ACCESS_KEY_ENV, rf.Prefix, LEGACY_ACCESS_ENV)
+		return errors.New(e)
+	}
+	secret := rf.getenv(SECRET_ENV, LEGACY_SECRET_ENV)
+	if secret == "" {
+		e := fmt.Sprintf("roles_env.rolesEnvRead: neither %s%s nor %s%s is set",
+			rf.Prefix, SECRET_ENV, rf.Prefix, LEGACY_SECRET_ENV)
+		return errors.New(e)
+	}
+	token := rf.getenv(TOKEN_ENV)
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.roleFields.AccessKey = accessKey
+	rf.roleFields.Secret = secret
+	rf.roleFields.Token = token
+	rf.lock.Unlock()
+	log.Printf("roles_env.rolesEnvRead: succesful assignment of role data\n")
+	return nil
+}
@@ -0,0 +1,75 @@
+package roles_env
+
+import (
+	roles "github.com/smugmug/goawsroles/roles"
+	"os"
+	"testing"
+)
+
+func TestRolesEnv(t *testing.T) {
+	os.Setenv("TEST1_"+ACCESS_KEY_ENV, "accesskey")
+	os.Setenv("TEST1_"+SECRET_ENV, "secretkey")
+	os.Setenv("TEST1_"+TOKEN_ENV, "token")
+	defer os.Unsetenv("TEST1_" + ACCESS_KEY_ENV)
+	defer os.Unsetenv("TEST1_" + SECRET_ENV)
+	defer os.Unsetenv("TEST1_" + TOKEN_ENV)
+
+	re := NewRolesEnvPrefix("TEST1_")
+	if !re.IsEmpty() {
+		t.Errorf("new RolesEnv is not empty?")
+	}
+	rr_err := roles.RolesReader(re).RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	if !re.UsingIAM() {
+		t.Errorf("a session token is set, UsingIAM should be true")
+	}
+	accessKey, secret, token, get_err := re.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "accesskey" || secret != "secretkey" || token != "token" {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+
+	// RolesRead picks up changes to the environment
+	os.Unsetenv("TEST1_" + TOKEN_ENV)
+	rr_err = re.RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	if re.UsingIAM() {
+		t.Errorf("no session token is set, UsingIAM should be false")
+	}
+	if _, token_err := re.GetToken(); token_err == nil {
+		t.Errorf("expected an error getting an unset token")
+	}
+}
+
+func TestRolesEnvLegacy(t *testing.T) {
+	os.Setenv("TEST2_"+LEGACY_ACCESS_ENV, "legacykey")
+	os.Setenv("TEST2_"+LEGACY_SECRET_ENV, "legacysecret")
+	defer os.Unsetenv("TEST2_" + LEGACY_ACCESS_ENV)
+	defer os.Unsetenv("TEST2_" + LEGACY_SECRET_ENV)
+
+	re := NewRolesEnvPrefix("TEST2_")
+	rr_err := re.RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, _, get_err := re.Get()
+	if get_err != nil || accessKey != "legacykey" || secret != "legacysecret" {
+		t.Errorf("unexpected legacy role data: %s %s %v", accessKey, secret, get_err)
+	}
+}
+
+func TestRolesEnvMissing(t *testing.T) {
+	re := NewRolesEnvPrefix("TEST3_NOT_SET_")
+	if re.RolesRead() == nil {
+		t.Errorf("expected an error with no variables set")
+	}
+	if !re.IsEmpty() {
+		t.Errorf("failed read should leave RolesEnv empty")
+	}
+}
@@ -6,13 +6,16 @@
 package roles_files
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	fsnotify "github.com/howeyc/fsnotify"
+	fswatch "github.com/smugmug/goawsroles/internal/fswatch"
 	roles "github.com/smugmug/goawsroles/roles"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -21,21 +24,98 @@ import (
 
 const (
 	ROLE_PROVIDER = "file"
+
+	// DEFAULT_RETRY_BACKOFF is the first wait before re-reading after a failed reload under
+	// KEEP_LAST_GOOD. It doubles on each failure up to DEFAULT_MAX_RETRY_BACKOFF.
+	DEFAULT_RETRY_BACKOFF     = time.Second
+	DEFAULT_MAX_RETRY_BACKOFF = time.Minute
+
+	// DEFAULT_SETTLE_INTERVAL is how long RolesWatch waits without further events on the
+	// role files before reading them.
+	DEFAULT_SETTLE_INTERVAL = time.Second
+	// DEFAULT_MAX_MTIME_SKEW is how far apart the mtimes of the three role files may be.
+	DEFAULT_MAX_MTIME_SKEW = 10 * time.Second
 )
 
+// ReloadPolicy says what happens to the current credentials when reading the files fails.
+type ReloadPolicy int
+
+const (
+	// ZERO_ON_ERROR zeroes the credentials and the file names, as RolesFiles always has.
+	ZERO_ON_ERROR ReloadPolicy = iota
+	// KEEP_LAST_GOOD keeps serving the last credentials read until they expire. RolesWatch
+	// re-reads with backoff and sends a *DegradedError on err_chan for each failure.
+	KEEP_LAST_GOOD
+)
+
+// DegradedError reports a failed read while the last-good credentials are still served.
+type DegradedError struct {
+	Err error
+	// Generation and Expiration describe the credentials still being served.
+	Generation uint64
+	Expiration time.Time
+}
+
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("roles_files: serving last-good credentials (generation %d): %s",
+		e.Generation, e.Err.Error())
+}
+
 // RolesFiles describes the location of roles files as well as a lock for safe access.
+// Credentials are read either from the three files AccessKeyFile, SecretFile and TokenFile,
+// or, if JSONFile is set, from a single JSON document in the STS/IMDS shape
+// (AccessKeyId, SecretAccessKey, Token or SessionToken, Expiration).
 type RolesFiles struct {
-	BaseDir       string
+	// BaseDir is the directory relative file names are read from. It may be empty if every
+	// file name is an absolute path.
+	BaseDir string
+	// AccessKeyFile, SecretFile, TokenFile and JSONFile are names relative to BaseDir, which
+	// they may not escape, or absolute paths in directories of their own.
 	AccessKeyFile string
 	SecretFile    string
 	TokenFile     string
-	roleFields    *roles.RolesFields
-	lock          sync.RWMutex
+	JSONFile      string
+	// AllowedRoot, if set, is a directory every role file must be inside.
+	AllowedRoot string
+	// ExpiringWindow is how long before a known Expiration RolesWatch publishes an Expiring
+	// event. If zero, roles.DEFAULT_REFRESH_WINDOW is used.
+	ExpiringWindow time.Duration
+	// ReloadPolicy applies to failed reads by both RolesRead and RolesWatch.
+	ReloadPolicy ReloadPolicy
+	// RetryBackoff and MaxRetryBackoff bound the re-reads RolesWatch makes after a failure
+	// under KEEP_LAST_GOOD. If zero, the DEFAULT_ values are used.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// SettleInterval is the quiet period RolesWatch waits for after the last event on the
+	// role files before reading them. If zero, DEFAULT_SETTLE_INTERVAL is used.
+	SettleInterval time.Duration
+	// MaxMtimeSkew is how far apart the mtimes of AccessKeyFile, SecretFile and TokenFile may
+	// be for them to be read as one set. If zero, DEFAULT_MAX_MTIME_SKEW is used.
+	MaxMtimeSkew time.Duration
+	// WatchMode selects filesystem notifications, polling, or both for RolesWatch.
+	WatchMode WatchMode
+	// PollInterval is how often the role files are polled under WATCH_POLL or WATCH_BOTH.
+	// If zero, DEFAULT_POLL_INTERVAL is used.
+	PollInterval time.Duration
+	// EnforcePermissions refuses role files that are group or world readable, not owned by
+	// OwnerUID and OwnerGID, or symlinks that resolve outside BaseDir (or outside the
+	// directory of an absolute file name). It applies to RolesRead and RolesWatch alike.
+	EnforcePermissions bool
+	// OwnerUID and OwnerGID are the expected owners of the role files under
+	// EnforcePermissions. NewRolesFiles sets them to -1, which accepts any owner.
+	OwnerUID   int
+	OwnerGID   int
+	roleFields *roles.RolesFields
+	lock       sync.RWMutex
+	snapshot   roles.CredentialsStore
+	notifier   roles.Notifier
 }
 
 // NewRolesFiles returns a pointer to a RolesFields instance.
 func NewRolesFiles() *RolesFiles {
 	r := new(RolesFiles)
+	r.OwnerUID = -1
+	r.OwnerGID = -1
 	r.roleFields = roles.NewRolesFields()
 	return r
 }
@@ -53,6 +133,9 @@ func (rf *RolesFiles) UsingIAM() bool {
 
 // IsEmpty determines if a RolesFiles struct is uninitialized.
 func (rf *RolesFiles) IsEmpty() bool {
+	if rf.JSONFile != "" {
+		return rf.roleFields.IsEmpty()
+	}
 	return rf.AccessKeyFile == "" ||
 		rf.SecretFile == "" ||
 		rf.TokenFile == "" ||
@@ -65,98 +148,450 @@ func (rf *RolesFiles) ZeroRoles() {
 	rf.AccessKeyFile = ""
 	rf.SecretFile = ""
 	rf.TokenFile = ""
+	rf.JSONFile = ""
 	rf.roleFields.ZeroRoles()
+	old := rf.generation()
+	rf.snapshot.Zero()
 	rf.lock.Unlock()
+	rf.notifier.Publish(roles.Event{Type: roles.Zeroed, Provider: ROLE_PROVIDER, OldGeneration: old})
 }
 
-// RolesRead populates rolesFields with blocking refresh of files
+// RolesRead populates rolesFields with blocking refresh of files. On failure the
+// ReloadPolicy decides whether the current credentials are kept.
 func (rf *RolesFiles) RolesRead() error {
 	roles_err := rf.rolesFilesRead()
 	if roles_err != nil {
-		rf.ZeroRoles()
+		return rf.readFailed(roles_err)
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. The files are read as by RolesRead, but on
+// failure the current credentials and file names are kept whatever the ReloadPolicy, and only
+// a ReadFailed event is published.
+func (rf *RolesFiles) RolesReread() error {
+	roles_err := rf.rolesFilesRead()
+	if roles_err != nil {
+		rf.publishReadFailed(roles_err)
 		return roles_err
 	}
 	return nil
 }
 
+// readFailed applies the ReloadPolicy after roles_err and returns the error to report:
+// a *DegradedError if the last-good credentials are kept, otherwise roles_err.
+func (rf *RolesFiles) readFailed(roles_err error) error {
+	rf.publishReadFailed(roles_err)
+	if rf.ReloadPolicy != KEEP_LAST_GOOD {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	c := rf.snapshot.Load()
+	if c == nil {
+		return roles_err
+	}
+	if c.IsExpired(0) {
+		// nothing left worth serving, but keep the file names so a retry can recover
+		rf.zeroCredentials()
+		return roles_err
+	}
+	return &DegradedError{Err: roles_err, Generation: c.Generation, Expiration: c.Expiration}
+}
+
+// zeroCredentials is ZeroRoles without forgetting the file names.
+func (rf *RolesFiles) zeroCredentials() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	old := rf.generation()
+	rf.snapshot.Zero()
+	rf.lock.Unlock()
+	rf.notifier.Publish(roles.Event{Type: roles.Zeroed, Provider: ROLE_PROVIDER, OldGeneration: old})
+}
+
+// Subscribe returns a channel receiving an Event for each rotation, failed read, zeroing and
+// approaching expiration. Events that do not fit in the buffer are dropped rather than
+// stalling RolesWatch. The returned func ends the subscription.
+func (rf *RolesFiles) Subscribe(buffer int) (<-chan roles.Event, func()) {
+	return rf.notifier.Subscribe(buffer)
+}
+
+// SubscribeFunc calls f with each Event on a goroutine of its own. See Subscribe.
+func (rf *RolesFiles) SubscribeFunc(f func(roles.Event)) func() {
+	return rf.notifier.SubscribeFunc(f)
+}
+
+// generation returns the generation of the current snapshot, or 0 if there is none.
+func (rf *RolesFiles) generation() uint64 {
+	if c := rf.snapshot.Load(); c != nil {
+		return c.Generation
+	}
+	return 0
+}
+
+// publishRotated stores fields as the next snapshot and announces it.
+// the caller must hold the write lock.
+func (rf *RolesFiles) publishRotated() {
+	old := rf.generation()
+	c := rf.snapshot.Store(ROLE_PROVIDER, rf.roleFields)
+	rf.notifier.Publish(roles.Event{Type: roles.Rotated, Provider: ROLE_PROVIDER,
+		OldGeneration: old, NewGeneration: c.Generation, Expiration: c.Expiration})
+}
+
+func (rf *RolesFiles) publishReadFailed(roles_err error) {
+	gen := rf.generation()
+	rf.notifier.Publish(roles.Event{Type: roles.ReadFailed, Provider: ROLE_PROVIDER,
+		OldGeneration: gen, NewGeneration: gen, Err: roles_err})
+}
+
 // RolesWatch catches filesystem notify events to determine when new roles files are ready to be read
-// in and used as new authentication values.
+// in and used as new authentication values. It runs until the underlying watcher fails; use
+// RolesWatchContext if the watch must be stopped.
 func (rf *RolesFiles) RolesWatch(err_chan chan error, read_signal chan bool) {
+	rf.RolesWatchContext(context.Background(), err_chan, read_signal)
+}
+
+// RolesWatchContext is RolesWatch bounded by ctx. When ctx is done the fsnotify watcher is
+// closed, its channels are drained, and ctx.Err() is sent on err_chan as the final value.
+// If the watcher shuts down on its own, the final value is nil. Callers cancelling ctx should
+// keep receiving on err_chan until that final value arrives.
+// read_signal may be nil if the caller listens through Subscribe instead; a non-nil
+// read_signal must be received from, or the watch blocks on each successful re-read.
+func (rf *RolesFiles) RolesWatchContext(ctx context.Context, err_chan chan error, read_signal chan bool) {
 	log.Printf("initiate roles watching\n")
-	watcher, watcher_err := fsnotify.NewWatcher()
-	if watcher_err != nil {
-		err_chan <- watcher_err
+	var watcher *fsnotify.Watcher
+	// nil channels never deliver, so a poll-only watch leaves these unset
+	var watcher_events chan *fsnotify.FileEvent
+	var watcher_errs chan error
+	if rf.usesFsnotify() {
+		var watcher_err error
+		watcher, watcher_err = fsnotify.NewWatcher()
+		if watcher_err != nil {
+			err_chan <- watcher_err
+			return
+		}
+		// each role file may live in a directory of its own
+		watch_dirs := rf.watchDirs()
+		if len(watch_dirs) == 0 {
+			watcher.Close()
+			err_chan <- errors.New("roles_files.RolesWatch: no directory to watch")
+			return
+		}
+		for _, dir := range watch_dirs {
+			watch_err := watcher.Watch(dir)
+			if watch_err != nil {
+				watcher.Close()
+				err_chan <- watch_err
+				return
+			}
+		}
+		watcher_events, watcher_errs = watcher.Event, watcher.Error
 	}
-	watch_err := watcher.Watch(rf.BaseDir)
-	if watch_err != nil {
-		err_chan <- watch_err
+	// events are matched on cleaned absolute paths, so neighbouring files such as
+	// role_token.tmp or old_role_token are never mistaken for the role files
+	is_path := func(ev_path, label, name string) bool {
+		role_path, path_err := rf.rolePath(label, name)
+		if path_err != nil {
+			return false
+		}
+		abs, abs_err := filepath.Abs(role_path)
+		return abs_err == nil && ev_path == abs
+	}
+	is_swap := func(ev_path string) bool {
+		base_abs, abs_err := filepath.Abs(rf.BaseDir)
+		return rf.BaseDir != "" && abs_err == nil && ev_path == filepath.Join(base_abs, ATOMIC_DATA_DIR)
+	}
+	var poll *time.Ticker
+	var poll_c <-chan time.Time
+	var poll_last map[string]file_fingerprint
+	if rf.usesPolling() {
+		poll = time.NewTicker(rf.pollInterval())
+		poll_c = poll.C
+		poll_last = rf.fingerprints()
 	}
-	defer watcher.Close()
 	touched_access_file := false
 	touched_secret_file := false
 	touched_token_file := false
-	func() {
+	expiring_gen := uint64(0)
+	var expiring *time.Timer
+	var expiring_c <-chan time.Time
+	backoff := time.Duration(0)
+	var retry *time.Timer
+	var retry_c <-chan time.Time
+	last_ev_s := ""
+	var settle *time.Timer
+	var settle_c <-chan time.Time
+	// settle (re)starts the quiet period after an event on one of the role files
+	settle_after := func(ev_s string) {
+		last_ev_s = ev_s
+		if settle != nil {
+			settle.Stop()
+		}
+		settle = time.NewTimer(rf.settleInterval())
+		settle_c = settle.C
+	}
+	// reload re-reads the files, and under KEEP_LAST_GOOD arms a retry with backoff
+	// if that fails. It returns false if ctx was done.
+	reload := func(ev_s string) bool {
+		ok, read_err := rf.watchReload(ctx, err_chan, read_signal, ev_s)
+		if poll != nil {
+			// changes already read in should not be found again by the next poll
+			poll_last = rf.fingerprints()
+		}
+		if retry != nil {
+			retry.Stop()
+		}
+		retry, retry_c = nil, nil
+		if read_err == nil || rf.ReloadPolicy != KEEP_LAST_GOOD {
+			backoff = 0
+			return ok
+		}
+		backoff = rf.nextBackoff(backoff)
+		log.Printf("roles_files.RolesWatch: retry read in %v\n", backoff)
+		retry = time.NewTimer(backoff)
+		retry_c = retry.C
+		return ok
+	}
+	final_err := func() error {
 		for {
+			// arm an Expiring event for each new generation with a known expiration
+			if c := rf.snapshot.Load(); c != nil && c.Generation != expiring_gen {
+				expiring_gen = c.Generation
+				if expiring != nil {
+					expiring.Stop()
+				}
+				expiring, expiring_c = nil, nil
+				if expiration, ok := c.ExpiresAt(); ok {
+					expiring = time.NewTimer(time.Until(expiration.Add(-rf.expiringWindow())))
+					expiring_c = expiring.C
+				}
+			}
 			select {
-			case ev := <-watcher.Event:
-				func() {
-					if ev.IsModify() || ev.IsCreate() {
-						ev_s := ev.String()
-						// collect events for all of the role files.
-						// we only want to read in and reset the
-						// strings when all have been written - to
-						// do so earlier would leave the strings
-						// in an inconsistent state
-						if strings.Contains(ev_s, rf.AccessKeyFile) {
-							touched_access_file = true
-						}
-						if strings.Contains(ev_s, rf.SecretFile) {
-							touched_secret_file = true
-						}
-						if strings.Contains(ev_s, rf.TokenFile) {
-							touched_token_file = true
-						}
-						// once we have seen all of the role files trigger
-						// events, we want to lock access, read them in,
-						// unlock access, and unset our flags
-						if touched_access_file &&
-							touched_secret_file &&
-							touched_token_file {
-							// our existing perms should be adequate while
-							// we provide for writes of new perms files to
-							// finish.
-							log.Printf("roles_files.RolesWatch: " +
-								"sleep (1) to allow file ops to complete")
-							time.Sleep(time.Duration(1) * time.Second)
-							roles_err := rf.rolesFilesRead()
-							if roles_err != nil {
-								e := fmt.Sprintf("roles_files.RolesWatch: "+
-									"zeroing all roles on err:%s",
-									roles_err.Error())
-								log.Printf(e)
-								rf.ZeroRoles()
-								err_chan <- roles_err
-							} else {
-								log.Printf("roles_files.RolesWatch: "+
-									"succesful re-read on %s\n",
-									ev_s)
-								touched_access_file = false
-								touched_secret_file = false
-								touched_token_file = false
-								read_signal <- true
-							}
-						}
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-settle_c:
+				settle_c = nil
+				if rf.WatchMode == WATCH_POLL {
+					// without events to restart the quiet period, check
+					// directly that nothing changed while settling
+					current := rf.fingerprints()
+					if len(changedFiles(poll_last, current)) != 0 {
+						poll_last = current
+						settle_after(last_ev_s)
+						continue
+					}
+				}
+				// no events for a full SettleInterval, so the writer is done
+				touched_access_file = false
+				touched_secret_file = false
+				touched_token_file = false
+				if !reload(last_ev_s) {
+					return ctx.Err()
+				}
+			case <-retry_c:
+				retry_c = nil
+				if !reload("retry") {
+					return ctx.Err()
+				}
+			case <-expiring_c:
+				expiring_c = nil
+				if c := rf.snapshot.Load(); c != nil && c.Generation == expiring_gen {
+					rf.notifier.Publish(roles.Event{Type: roles.Expiring, Provider: ROLE_PROVIDER,
+						OldGeneration: c.Generation, NewGeneration: c.Generation, Expiration: c.Expiration})
+				}
+			case <-poll_c:
+				current := rf.fingerprints()
+				changed := changedFiles(poll_last, current)
+				poll_last = current
+				if len(changed) == 0 {
+					continue
+				}
+				ev_s := "poll: " + strings.Join(changed, " ")
+				if rf.JSONFile != "" {
+					settle_after(ev_s)
+					continue
+				}
+				for _, name := range changed {
+					touched_access_file = touched_access_file || name == rf.AccessKeyFile
+					touched_secret_file = touched_secret_file || name == rf.SecretFile
+					touched_token_file = touched_token_file || name == rf.TokenFile
+				}
+				if touched_access_file &&
+					touched_secret_file &&
+					touched_token_file {
+					settle_after(ev_s)
+				}
+			case ev, ok := <-watcher_events:
+				if !ok {
+					return nil
+				}
+				if !(ev.IsModify() || ev.IsCreate()) {
+					continue
+				}
+				ev_s := ev.String()
+				ev_path, ev_err := filepath.Abs(ev.Name)
+				if ev_err != nil {
+					continue
+				}
+				if is_swap(ev_path) && ev.IsCreate() {
+					// the ..data link was swapped, replacing every file at once.
+					// the files in BaseDir are symlinks and see no events of their own
+					touched_access_file = true
+					touched_secret_file = true
+					touched_token_file = true
+					settle_after(ev_s)
+					continue
+				}
+				if rf.JSONFile != "" {
+					// a single document carries all of the credentials, so
+					// it is read once writes to it settle
+					if is_path(ev_path, "JSONFile", rf.JSONFile) {
+						settle_after(ev_s)
 					}
-				}()
-			case err := <-watcher.Error:
+					continue
+				}
+				// collect events for all of the role files.
+				// we only want to read in and reset the
+				// strings when all have been written and
+				// the writes have settled - to do so earlier
+				// would leave the strings in an inconsistent state.
+				// a rename into place is a create of the role file
+				matched := false
+				if is_path(ev_path, "AccessKeyFile", rf.AccessKeyFile) {
+					touched_access_file = true
+					matched = true
+				}
+				if is_path(ev_path, "SecretFile", rf.SecretFile) {
+					touched_secret_file = true
+					matched = true
+				}
+				if is_path(ev_path, "TokenFile", rf.TokenFile) {
+					touched_token_file = true
+					matched = true
+				}
+				// once we have seen all of the role files trigger
+				// events, each further event restarts the quiet
+				// period; our existing perms should be adequate
+				// while the writes of new perms files finish.
+				if matched &&
+					touched_access_file &&
+					touched_secret_file &&
+					touched_token_file {
+					settle_after(ev_s)
+				}
+			case err, ok := <-watcher_errs:
+				if !ok {
+					return nil
+				}
 				// return an error to the caller via the channel
-				err_chan <- err
+				select {
+				case err_chan <- err:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
 		}
 	}()
-	// typically not reached, but signifies normal termination
+	if expiring != nil {
+		expiring.Stop()
+	}
+	if retry != nil {
+		retry.Stop()
+	}
+	if settle != nil {
+		settle.Stop()
+	}
+	if poll != nil {
+		poll.Stop()
+	}
+	if watcher != nil {
+		watcher.Close()
+		go fswatch.Drain(watcher)
+	}
 	log.Printf("terminating roles watching\n")
-	err_chan <- nil
+	err_chan <- final_err
+}
+
+// watchReload re-reads the roles files on behalf of RolesWatchContext and reports the outcome
+// on err_chan or read_signal. It returns false if ctx was done before the outcome was delivered,
+// and the read error if there was one.
+func (rf *RolesFiles) watchReload(ctx context.Context, err_chan chan error, read_signal chan bool, ev_s string) (bool, error) {
+	roles_err := rf.rolesFilesRead()
+	if roles_err != nil {
+		report_err := rf.readFailed(roles_err)
+		if _, degraded := report_err.(*DegradedError); degraded {
+			log.Print("roles_files.RolesWatch: " + report_err.Error())
+		} else {
+			log.Print("roles_files.RolesWatch: zeroing roles on err:" + roles_err.Error())
+		}
+		select {
+		case err_chan <- report_err:
+			return true, roles_err
+		case <-ctx.Done():
+			return false, roles_err
+		}
+	}
+	log.Printf("roles_files.RolesWatch: "+
+		"succesful re-read on %s\n",
+		ev_s)
+	if read_signal == nil {
+		return true, nil
+	}
+	select {
+	case read_signal <- true:
+		return true, nil
+	case <-ctx.Done():
+		return false, nil
+	}
+}
+
+// nextBackoff doubles backoff within RetryBackoff and MaxRetryBackoff.
+func (rf *RolesFiles) nextBackoff(backoff time.Duration) time.Duration {
+	initial, max := rf.RetryBackoff, rf.MaxRetryBackoff
+	if initial <= 0 {
+		initial = DEFAULT_RETRY_BACKOFF
+	}
+	if max <= 0 {
+		max = DEFAULT_MAX_RETRY_BACKOFF
+	}
+	if backoff <= 0 {
+		return initial
+	}
+	backoff *= 2
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+func (rf *RolesFiles) expiringWindow() time.Duration {
+	if rf.ExpiringWindow > 0 {
+		return rf.ExpiringWindow
+	}
+	return roles.DEFAULT_REFRESH_WINDOW
+}
+
+// ExpiresAt returns the expiration of the current credentials, and false if it is not known.
+func (rf *RolesFiles) ExpiresAt() (time.Time, bool) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.ExpiresAt()
+}
+
+// IsExpired reports whether the current credentials expire within skew of now.
+func (rf *RolesFiles) IsExpired(skew time.Duration) bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsExpired(skew)
+}
+
+// Credentials returns the snapshot made by the last successful read. It is loaded from an
+// atomic pointer, so it does not wait on a reload in progress.
+func (rf *RolesFiles) Credentials() (*roles.Credentials, error) {
+	c := rf.snapshot.Load()
+	if c == nil {
+		return nil, errors.New("roles_files.Credentials: no credentials loaded")
+	}
+	return c, nil
 }
 
 // Get returns the (accessKey,secret,token), or an error.
@@ -236,14 +671,28 @@ func role_file_bytes(role_file_path string) ([]byte, error) {
 	return role_file_bytes, nil
 }
 
-// safety check - the mtimes of the role files should be within sixty seconds of another
-func valid_mtime_range(ts []time.Time) bool {
-	uts := make([]int, len(ts))
+// safety check - the mtimes of the role files should be within max_skew of another
+func valid_mtime_range(ts []time.Time, max_skew time.Duration) bool {
+	uts := make([]int64, len(ts))
 	for i, _ := range ts {
-		uts[i] = int(ts[i].Unix())
+		uts[i] = ts[i].UnixNano()
+	}
+	sort.Slice(uts, func(i, j int) bool { return uts[i] > uts[j] })
+	return time.Duration(uts[0]-uts[len(uts)-1]) < max_skew
+}
+
+func (rf *RolesFiles) settleInterval() time.Duration {
+	if rf.SettleInterval > 0 {
+		return rf.SettleInterval
 	}
-	sort.Sort(sort.Reverse(sort.IntSlice(uts)))
-	return ((uts[0] - uts[len(uts)-1]) < 10)
+	return DEFAULT_SETTLE_INTERVAL
+}
+
+func (rf *RolesFiles) maxMtimeSkew() time.Duration {
+	if rf.MaxMtimeSkew > 0 {
+		return rf.MaxMtimeSkew
+	}
+	return DEFAULT_MAX_MTIME_SKEW
 }
 
 func validFileName(n string) bool {
@@ -254,34 +703,42 @@ func validFileName(n string) bool {
 func (rf *RolesFiles) rolesFilesRead() error {
 	rf.lock.Lock()
 	defer rf.lock.Unlock()
-	if rf.BaseDir == "" {
+	if rf.JSONFile != "" {
+		return rf.rolesJSONRead()
+	}
+	if rf.BaseDir == "" && !(filepath.IsAbs(rf.AccessKeyFile) &&
+		filepath.IsAbs(rf.SecretFile) && filepath.IsAbs(rf.TokenFile)) {
 		e := fmt.Sprintf("roles_files.rolesFilesRead: must specify a non-empty BaseDir")
 		return errors.New(e)
 	}
+	data_dir, swapped := rf.readDir()
+	// an atomic swap only vouches for the files that are read through it
+	swapped = swapped && !filepath.IsAbs(rf.AccessKeyFile) &&
+		!filepath.IsAbs(rf.SecretFile) && !filepath.IsAbs(rf.TokenFile)
 
-	if !validFileName(rf.AccessKeyFile) {
-		return errors.New("roles_files.rolesFilesRead: invalid AccessKeyFile")
+	accessKey_path, accessKey_path_err := rf.readPath("AccessKeyFile", rf.AccessKeyFile, data_dir)
+	if accessKey_path_err != nil {
+		return accessKey_path_err
 	}
-	accessKey_path := rf.BaseDir + string(os.PathSeparator) + rf.AccessKeyFile
-	accessKey_bytes, accessKey_err := role_file_bytes(accessKey_path)
+	accessKey_bytes, accessKey_err := rf.readRoleFile("AccessKeyFile", rf.AccessKeyFile, accessKey_path)
 	if accessKey_err != nil {
 		return accessKey_err
 	}
 
-	if !validFileName(rf.SecretFile) {
-		return errors.New("roles_files.rolesFilesRead: invalid SecretFile")
+	secret_path, secret_path_err := rf.readPath("SecretFile", rf.SecretFile, data_dir)
+	if secret_path_err != nil {
+		return secret_path_err
 	}
-	secret_path := rf.BaseDir + string(os.PathSeparator) + rf.SecretFile
-	secret_bytes, secret_err := role_file_bytes(secret_path)
+	secret_bytes, secret_err := rf.readRoleFile("SecretFile", rf.SecretFile, secret_path)
 	if secret_err != nil {
 		return secret_err
 	}
 
-	if !validFileName(rf.TokenFile) {
-		return errors.New("roles_files.rolesFilesRead: invalid TokenFile")
+	token_path, token_path_err := rf.readPath("TokenFile", rf.TokenFile, data_dir)
+	if token_path_err != nil {
+		return token_path_err
 	}
-	token_path := rf.BaseDir + string(os.PathSeparator) + rf.TokenFile
-	token_bytes, token_err := role_file_bytes(token_path)
+	token_bytes, token_err := rf.readRoleFile("TokenFile", rf.TokenFile, token_path)
 	if token_err != nil {
 		return token_err
 	}
@@ -298,14 +755,46 @@ func (rf *RolesFiles) rolesFilesRead() error {
 		uts = append(uts, role_file_stat.ModTime())
 	}
 
-	if valid_mtime_range(uts) {
+	// files published together by an atomic swap are consistent whatever their mtimes
+	if swapped || valid_mtime_range(uts, rf.maxMtimeSkew()) {
 		rf.roleFields.AccessKey = string(accessKey_bytes)
 		rf.roleFields.Secret = string(secret_bytes)
 		rf.roleFields.Token = string(token_bytes)
+		rf.roleFields.Expiration = time.Time{}
+		rf.roleFields.IssuedAt = time.Time{}
+		rf.publishRotated()
 		log.Printf("roles_files.rolesFilesRead: succesful assignment of role data\n")
 		return nil
 	} else {
-		e := fmt.Sprintf("roles_files.rolesFilesRead: range of mtimes of roles files >10 seconds")
+		e := fmt.Sprintf("roles_files.rolesFilesRead: range of mtimes of roles files >=%v",
+			rf.maxMtimeSkew())
 		return errors.New(e)
 	}
 }
+
+// will read in the single json role file and swap all of its fields in at once.
+// the caller must hold the write lock.
+func (rf *RolesFiles) rolesJSONRead() error {
+	data_dir, _ := rf.readDir()
+	json_path, json_path_err := rf.readPath("JSONFile", rf.JSONFile, data_dir)
+	if json_path_err != nil {
+		return json_path_err
+	}
+	json_bytes, json_err := rf.readRoleFile("JSONFile", rf.JSONFile, json_path)
+	if json_err != nil {
+		return json_err
+	}
+	fields, parse_err := roles.ParseRolesJSON(json_bytes)
+	if parse_err != nil {
+		e := fmt.Sprintf("roles_files.rolesJSONRead: %s: %s", json_path, parse_err.Error())
+		return errors.New(e)
+	}
+	if fields.Token == "" {
+		e := fmt.Sprintf("roles_files.rolesJSONRead: %s: empty Token", json_path)
+		return errors.New(e)
+	}
+	*rf.roleFields = *fields
+	rf.publishRotated()
+	log.Printf("roles_files.rolesJSONRead: succesful assignment of role data\n")
+	return nil
+}
@@ -0,0 +1,32 @@
+package roles_files
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ATOMIC_DATA_DIR is the symlink that Kubernetes Secret and ConfigMap volumes swap to publish
+// a new set of files at once. Each file in BaseDir is itself a symlink through it.
+const ATOMIC_DATA_DIR = "..data"
+
+// readDir returns the directory that relative role file names should be read from instead of
+// BaseDir, and true, if BaseDir is an atomic symlink-swap directory. The ..data link is resolved
+// once, so every file is read from the same generation. Otherwise it returns "" and false.
+func (rf *RolesFiles) readDir() (string, bool) {
+	if rf.BaseDir == "" {
+		return "", false
+	}
+	data_link := rf.BaseDir + string(os.PathSeparator) + ATOMIC_DATA_DIR
+	data_stat, data_err := os.Lstat(data_link)
+	if data_err != nil || data_stat.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+	target, target_err := os.Readlink(data_link)
+	if target_err != nil {
+		return "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(rf.BaseDir, target)
+	}
+	return target, true
+}
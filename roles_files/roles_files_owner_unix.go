@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package roles_files
+
+import (
+	"os"
+	"syscall"
+)
+
+// file_owner returns the uid and gid owning the file described by stat.
+func file_owner(stat os.FileInfo) (int, int, bool) {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(sys.Uid), int(sys.Gid), true
+}
@@ -0,0 +1,107 @@
+package roles_files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rolePath returns the cleaned path of the role file called name, described by label in errors.
+// A relative name is joined to BaseDir and may not escape it; an absolute name is used as is.
+// If AllowedRoot is set, the path must be inside it.
+func (rf *RolesFiles) rolePath(label, name string) (string, error) {
+	if !validFileName(name) {
+		e := fmt.Sprintf("roles_files.rolePath: invalid %s", label)
+		return "", errors.New(e)
+	}
+	role_path := filepath.Clean(name)
+	if !filepath.IsAbs(name) {
+		if rf.BaseDir == "" {
+			e := fmt.Sprintf("roles_files.rolePath: relative %s needs a non-empty BaseDir", label)
+			return "", errors.New(e)
+		}
+		role_path = filepath.Join(rf.BaseDir, name)
+		if !within(rf.BaseDir, role_path) {
+			e := fmt.Sprintf("roles_files.rolePath: %s %s is outside BaseDir", label, name)
+			return "", errors.New(e)
+		}
+	}
+	if rf.AllowedRoot != "" && !within(rf.AllowedRoot, role_path) {
+		e := fmt.Sprintf("roles_files.rolePath: %s %s is outside AllowedRoot %s",
+			label, role_path, rf.AllowedRoot)
+		return "", errors.New(e)
+	}
+	return role_path, nil
+}
+
+// readPath is rolePath for reading: relative names are read through data_dir instead of
+// BaseDir when it is set by an atomic swap (see readDir).
+func (rf *RolesFiles) readPath(label, name, data_dir string) (string, error) {
+	role_path, path_err := rf.rolePath(label, name)
+	if path_err != nil {
+		return "", path_err
+	}
+	if data_dir != "" && !filepath.IsAbs(name) {
+		return filepath.Join(data_dir, name), nil
+	}
+	return role_path, nil
+}
+
+// within reports whether p is strictly inside the directory root, after both are cleaned
+// and made absolute.
+func within(root, p string) bool {
+	abs_root, root_err := filepath.Abs(root)
+	abs_p, p_err := filepath.Abs(p)
+	if root_err != nil || p_err != nil {
+		return false
+	}
+	rel, rel_err := filepath.Rel(abs_root, abs_p)
+	if rel_err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// rolePaths returns the absolute paths of the role files in use, keyed by those paths.
+// Names that do not validate are left out.
+func (rf *RolesFiles) rolePaths() map[string]bool {
+	paths := make(map[string]bool)
+	labels := []string{"AccessKeyFile", "SecretFile", "TokenFile"}
+	names := []string{rf.AccessKeyFile, rf.SecretFile, rf.TokenFile}
+	if rf.JSONFile != "" {
+		labels, names = []string{"JSONFile"}, []string{rf.JSONFile}
+	}
+	for i, name := range names {
+		role_path, path_err := rf.rolePath(labels[i], name)
+		if path_err != nil {
+			continue
+		}
+		if abs, abs_err := filepath.Abs(role_path); abs_err == nil {
+			paths[abs] = true
+		}
+	}
+	return paths
+}
+
+// watchDirs returns the directories holding the role files, and BaseDir if it is set,
+// each once.
+func (rf *RolesFiles) watchDirs() []string {
+	seen := make(map[string]bool)
+	dirs := make([]string, 0)
+	if rf.BaseDir != "" {
+		if abs, abs_err := filepath.Abs(rf.BaseDir); abs_err == nil {
+			seen[abs] = true
+			dirs = append(dirs, abs)
+		}
+	}
+	for role_path, _ := range rf.rolePaths() {
+		dir := filepath.Dir(role_path)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,88 @@
+package roles_files
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// readRoleFile reads the role file called name from read_path. If EnforcePermissions is set
+// the file is first checked: it must resolve inside its root directory (BaseDir, or the
+// directory of an absolute name), be a regular file that is not group or world readable, and
+// be owned by OwnerUID and OwnerGID where those are not -1. The checked file is the one read.
+func (rf *RolesFiles) readRoleFile(label, name, read_path string) ([]byte, error) {
+	if !rf.EnforcePermissions {
+		return role_file_bytes(read_path)
+	}
+	root := rf.BaseDir
+	if filepath.IsAbs(name) {
+		root = filepath.Dir(filepath.Clean(name))
+	}
+	resolved_root, root_err := filepath.EvalSymlinks(root)
+	if root_err != nil {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s: %s", label, root_err.Error())
+		return nil, errors.New(e)
+	}
+	resolved, resolve_err := filepath.EvalSymlinks(read_path)
+	if resolve_err != nil {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s: %s", label, resolve_err.Error())
+		return nil, errors.New(e)
+	}
+	if !within(resolved_root, resolved) {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s %s is a symlink to %s, outside %s",
+			label, read_path, resolved, root)
+		return nil, errors.New(e)
+	}
+
+	// check and read the same open file, so it cannot be swapped in between
+	f, open_err := os.Open(resolved)
+	if open_err != nil {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s: %s", label, open_err.Error())
+		return nil, errors.New(e)
+	}
+	defer f.Close()
+	stat, stat_err := f.Stat()
+	if stat_err != nil {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s: %s", label, stat_err.Error())
+		return nil, errors.New(e)
+	}
+	if !stat.Mode().IsRegular() {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s %s is not a regular file", label, resolved)
+		return nil, errors.New(e)
+	}
+	if perm := stat.Mode().Perm(); perm&0044 != 0 {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s %s is group or world readable (mode %04o)",
+			label, resolved, perm)
+		return nil, errors.New(e)
+	}
+	if rf.OwnerUID != -1 || rf.OwnerGID != -1 {
+		uid, gid, ok := file_owner(stat)
+		if !ok {
+			e := fmt.Sprintf("roles_files.readRoleFile: %s: ownership cannot be checked on this platform",
+				label)
+			return nil, errors.New(e)
+		}
+		if rf.OwnerUID != -1 && uid != rf.OwnerUID {
+			e := fmt.Sprintf("roles_files.readRoleFile: %s %s is owned by uid %d, expected %d",
+				label, resolved, uid, rf.OwnerUID)
+			return nil, errors.New(e)
+		}
+		if rf.OwnerGID != -1 && gid != rf.OwnerGID {
+			e := fmt.Sprintf("roles_files.readRoleFile: %s %s is owned by gid %d, expected %d",
+				label, resolved, gid, rf.OwnerGID)
+			return nil, errors.New(e)
+		}
+	}
+	b, read_err := ioutil.ReadAll(f)
+	if read_err != nil {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s %s read err: %s", label, resolved, read_err.Error())
+		return nil, errors.New(e)
+	}
+	if len(b) == 0 {
+		e := fmt.Sprintf("roles_files.readRoleFile: %s %s is empty", label, resolved)
+		return nil, errors.New(e)
+	}
+	return b, nil
+}
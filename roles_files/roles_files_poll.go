@@ -0,0 +1,98 @@
+package roles_files
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// WatchMode selects how RolesWatch notices that the role files have changed.
+type WatchMode int
+
+const (
+	// WATCH_FSNOTIFY uses filesystem notifications only.
+	WATCH_FSNOTIFY WatchMode = iota
+	// WATCH_POLL stats the role files every PollInterval, for filesystems where notifications
+	// never arrive (NFS, some FUSE mounts, writers in another mount namespace).
+	WATCH_POLL
+	// WATCH_BOTH uses notifications, with polling as a safety net.
+	WATCH_BOTH
+)
+
+// DEFAULT_POLL_INTERVAL is how often the role files are polled if PollInterval is zero.
+const DEFAULT_POLL_INTERVAL = 10 * time.Second
+
+// file_fingerprint is what polling compares to decide that a role file changed.
+type file_fingerprint struct {
+	exists bool
+	mtime  time.Time
+	size   int64
+	hash   [sha256.Size]byte
+}
+
+func (rf *RolesFiles) usesFsnotify() bool {
+	return rf.WatchMode == WATCH_FSNOTIFY || rf.WatchMode == WATCH_BOTH
+}
+
+func (rf *RolesFiles) usesPolling() bool {
+	return rf.WatchMode == WATCH_POLL || rf.WatchMode == WATCH_BOTH
+}
+
+func (rf *RolesFiles) pollInterval() time.Duration {
+	if rf.PollInterval > 0 {
+		return rf.PollInterval
+	}
+	return DEFAULT_POLL_INTERVAL
+}
+
+// watchedFiles returns the names of the role files in use.
+func (rf *RolesFiles) watchedFiles() []string {
+	if rf.JSONFile != "" {
+		return []string{rf.JSONFile}
+	}
+	return []string{rf.AccessKeyFile, rf.SecretFile, rf.TokenFile}
+}
+
+// fingerprints stats and hashes each of the role files in use.
+func (rf *RolesFiles) fingerprints() map[string]file_fingerprint {
+	fps := make(map[string]file_fingerprint)
+	for _, name := range rf.watchedFiles() {
+		role_path, path_err := rf.rolePath("role file", name)
+		if path_err != nil {
+			continue
+		}
+		fps[name] = fingerprint(role_path)
+	}
+	return fps
+}
+
+// fingerprint returns the mtime, size and content hash of role_file_path. A file that cannot
+// be read has a fingerprint with exists false.
+func fingerprint(role_file_path string) file_fingerprint {
+	fp := file_fingerprint{}
+	stat, stat_err := os.Stat(role_file_path)
+	if stat_err != nil {
+		return fp
+	}
+	b, b_err := ioutil.ReadFile(role_file_path)
+	if b_err != nil {
+		return fp
+	}
+	fp.exists = true
+	fp.mtime = stat.ModTime()
+	fp.size = stat.Size()
+	fp.hash = sha256.Sum256(b)
+	return fp
+}
+
+// changedFiles returns the names whose fingerprint in current differs from last.
+func changedFiles(last, current map[string]file_fingerprint) []string {
+	changed := make([]string, 0)
+	for name, fp := range current {
+		if last_fp, ok := last[name]; !ok || last_fp != fp {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
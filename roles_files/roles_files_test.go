@@ -1,10 +1,14 @@
 package roles_files
 
 import (
+	"context"
 	"fmt"
 	roles "github.com/smugmug/goawsroles/roles"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -21,7 +25,7 @@ func TestRolesFiles(t *testing.T) {
 	rf := roles.RolesReader(rf_)
 	rr_err := rf.RolesRead()
 	if rr_err != nil {
-		t.Errorf(rr_err.Error())
+		t.Error(rr_err.Error())
 	}
 	access_key, access_key_err := rf.GetAccessKey()
 	if access_key_err != nil {
@@ -78,7 +82,7 @@ func TestRolesWatcher(t *testing.T) {
 				accessKey, secret, token, get_err := rw.Get()
 				if get_err != nil {
 					e := fmt.Sprintf("cannot get a role file:%s\n", get_err.Error())
-					t.Errorf(e)
+					t.Error(e)
 				} else {
 					fmt.Printf("new data\naccess key:%s\nsecret:%s\ntoken:%s\n",
 						accessKey, secret, token)
@@ -96,22 +100,765 @@ func TestRolesWatcher(t *testing.T) {
 	touch_cmd3 := exec.Command("touch", rw.BaseDir+string(filepath.Separator)+rw.TokenFile)
 	touch_err1 := touch_cmd1.Run()
 	if touch_err1 != nil {
-		t.Errorf(touch_err1.Error())
+		t.Error(touch_err1.Error())
 	}
 	touch_err2 := touch_cmd2.Run()
 	if touch_err2 != nil {
-		t.Errorf(touch_err2.Error())
+		t.Error(touch_err2.Error())
 	}
 	touch_err3 := touch_cmd3.Run()
 	if touch_err3 != nil {
-		t.Errorf(touch_err3.Error())
+		t.Error(touch_err3.Error())
 	}
 	time.Sleep(2 * time.Second)
 
 	watch_err := <-c
 	if watch_err != nil {
 		e := fmt.Sprintf("error from watcher: %s\n", watch_err.Error())
-		t.Errorf(e)
+		t.Error(e)
+	}
+}
+
+func TestRolesWatchContext(t *testing.T) {
+	rw := NewRolesFiles()
+	rw.BaseDir = "./test_files"
+	rw.AccessKeyFile = "role_access_key"
+	rw.SecretFile = "role_secret_key"
+	rw.TokenFile = "role_token"
+	rw_err := rw.RolesRead()
+	if rw_err != nil {
+		t.Errorf("roles read err: %s", rw_err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan error)
+	s := make(chan bool)
+	go rw.RolesWatchContext(ctx, c, s)
+
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	select {
+	case watch_err := <-c:
+		if watch_err != context.Canceled {
+			t.Errorf("expected context.Canceled from watcher, got %v", watch_err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("watcher did not terminate after cancel")
+	}
+}
+
+func TestRolesFilesJSON(t *testing.T) {
+	rf := NewRolesFiles()
+	rf.BaseDir = "./test_files"
+	rf.JSONFile = "role.json"
+	rr_err := rf.RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	if rf.IsEmpty() {
+		t.Errorf("json RolesFiles is empty after read")
+	}
+	accessKey, secret, token, get_err := rf.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "jsonaccesskey" || secret != "jsonsecretkey" || token != "jsontoken" {
+		t.Errorf("unexpected json role data: %s %s %s", accessKey, secret, token)
+	}
+	expiration, ok := rf.ExpiresAt()
+	if !ok || !expiration.Equal(time.Date(2015, 5, 12, 22, 39, 16, 0, time.UTC)) {
+		t.Errorf("unexpected expiration: %v %v", expiration, ok)
+	}
+	if !rf.IsExpired(0) {
+		t.Errorf("credentials from 2015 should be expired")
+	}
+}
+
+func TestRolesFilesCredentials(t *testing.T) {
+	rf := NewRolesFiles()
+	if _, c_err := rf.Credentials(); c_err == nil {
+		t.Errorf("expected an error before the first read")
+	}
+	rf.BaseDir = "./test_files"
+	rf.JSONFile = "role.json"
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	first, c_err := roles.Snapshot(rf)
+	if c_err != nil {
+		t.Fatal(c_err.Error())
+	}
+	if first.AccessKey != "jsonaccesskey" || first.Token != "jsontoken" || first.Generation != 1 ||
+		first.Provider != ROLE_PROVIDER || first.LoadedAt.IsZero() || first.Expiration.IsZero() {
+		t.Errorf("unexpected first snapshot: %+v", first)
+	}
+
+	// a reload publishes a new generation and leaves the old snapshot untouched
+	rf.JSONFile = ""
+	rf.AccessKeyFile = "role_access_key"
+	rf.SecretFile = "role_secret_key"
+	rf.TokenFile = "role_token"
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	second, c_err := rf.Credentials()
+	if c_err != nil {
+		t.Fatal(c_err.Error())
+	}
+	accessKey, _ := rf.GetAccessKey()
+	if second.Generation != 2 || second.AccessKey != accessKey || !second.Expiration.IsZero() {
+		t.Errorf("unexpected second snapshot: %+v", second)
+	}
+	if first.AccessKey != "jsonaccesskey" || first.Generation != 1 {
+		t.Errorf("first snapshot was modified: %+v", first)
+	}
+
+	rf.ZeroRoles()
+	if _, c_err := rf.Credentials(); c_err == nil {
+		t.Errorf("expected an error after ZeroRoles")
+	}
+}
+
+func TestRolesFilesEvents(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_files")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	write_json := func(accessKey string, expiration time.Time) {
+		j := fmt.Sprintf(`{"AccessKeyId":"%s","SecretAccessKey":"secret","Token":"token","Expiration":"%s"}`,
+			accessKey, expiration.UTC().Format(time.RFC3339))
+		// rename into place so the watch never reads a partial file
+		if write_err := ioutil.WriteFile(filepath.Join(dir, "staging.tmp"), []byte(j), 0600); write_err != nil {
+			t.Fatal(write_err.Error())
+		}
+		if rename_err := os.Rename(filepath.Join(dir, "staging.tmp"), filepath.Join(dir, "role.json")); rename_err != nil {
+			t.Fatal(rename_err.Error())
+		}
+	}
+	write_json("first", time.Now().Add(time.Minute))
+
+	rf := NewRolesFiles()
+	rf.BaseDir = dir
+	rf.JSONFile = "role.json"
+	events, unsubscribe := rf.Subscribe(10)
+	defer unsubscribe()
+	// a subscriber that never returns, and one that never reads, must not stall the watch
+	stuck := make(chan bool)
+	defer close(stuck)
+	defer rf.SubscribeFunc(func(roles.Event) { <-stuck })()
+	_, unread_unsubscribe := rf.Subscribe(1)
+	defer unread_unsubscribe()
+
+	next := func(expected roles.EventType) roles.Event {
+		select {
+		case ev := <-events:
+			if ev.Type != expected {
+				t.Fatalf("expected %s, got %s: %+v", expected, ev.Type, ev)
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", expected)
+		}
+		return roles.Event{}
+	}
+
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	if ev := next(roles.Rotated); ev.OldGeneration != 0 || ev.NewGeneration != 1 {
+		t.Errorf("unexpected generations: %+v", ev)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err_chan := make(chan error, 1)
+	go rf.RolesWatchContext(ctx, err_chan, nil)
+	// the one minute expiration is within the default window
+	if ev := next(roles.Expiring); ev.NewGeneration != 1 {
+		t.Errorf("unexpected Expiring event: %+v", ev)
+	}
+	time.Sleep(100 * time.Millisecond)
+	write_json("second", time.Now().Add(time.Hour))
+	if ev := next(roles.Rotated); ev.OldGeneration != 1 || ev.NewGeneration != 2 {
+		t.Errorf("unexpected generations: %+v", ev)
+	}
+	cancel()
+	if watch_err := <-err_chan; watch_err != context.Canceled {
+		t.Errorf("unexpected final watch value: %v", watch_err)
+	}
+	// one write may be seen as several events
+	for len(events) > 0 {
+		next(roles.Rotated)
+	}
+	if accessKey, _ := rf.GetAccessKey(); accessKey != "second" {
+		t.Errorf("unexpected access key: %s", accessKey)
+	}
+
+	rf.JSONFile = "missing.json"
+	if rf.RolesRead() == nil {
+		t.Fatal("expected an error reading a missing file")
+	}
+	if ev := next(roles.ReadFailed); ev.Err == nil {
+		t.Errorf("ReadFailed without Err: %+v", ev)
+	}
+	next(roles.Zeroed)
+}
+
+func TestRolesFilesKeepLastGood(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_files")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	write := func(j string) {
+		if write_err := ioutil.WriteFile(filepath.Join(dir, "staging.tmp"), []byte(j), 0600); write_err != nil {
+			t.Fatal(write_err.Error())
+		}
+		if rename_err := os.Rename(filepath.Join(dir, "staging.tmp"), filepath.Join(dir, "role.json")); rename_err != nil {
+			t.Fatal(rename_err.Error())
+		}
+	}
+	good := func(accessKey string, expiration time.Time) string {
+		return fmt.Sprintf(`{"AccessKeyId":"%s","SecretAccessKey":"secret","Token":"token","Expiration":"%s"}`,
+			accessKey, expiration.UTC().Format(time.RFC3339))
+	}
+	write(good("first", time.Now().Add(time.Hour)))
+
+	rf := NewRolesFiles()
+	rf.BaseDir = dir
+	rf.JSONFile = "role.json"
+	rf.ReloadPolicy = KEEP_LAST_GOOD
+	rf.RetryBackoff = 50 * time.Millisecond
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	events, unsubscribe := rf.Subscribe(100)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err_chan := make(chan error)
+	go rf.RolesWatchContext(ctx, err_chan, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	// a bad write is reported and retried, and the last-good credentials stay in place
+	write(`{"AccessKeyId":`)
+	for degraded := 0; degraded < 3; {
+		select {
+		case watch_err := <-err_chan:
+			d, ok := watch_err.(*DegradedError)
+			if !ok {
+				t.Fatalf("expected a DegradedError, got %v", watch_err)
+			}
+			if d.Generation != 1 {
+				t.Errorf("unexpected generation served: %d", d.Generation)
+			}
+			degraded++
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for retries")
+		}
+		if accessKey, _, _, get_err := rf.Get(); get_err != nil || accessKey != "first" {
+			t.Fatalf("last-good credentials were not kept: %s %v", accessKey, get_err)
+		}
+	}
+
+	// the next good write recovers, even if it is only found by a retry
+	write(good("second", time.Now().Add(time.Hour)))
+	recovered := false
+	for !recovered {
+		select {
+		case <-err_chan:
+		case ev := <-events:
+			recovered = ev.Type == roles.Rotated
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting to recover")
+		}
+	}
+	if accessKey, _ := rf.GetAccessKey(); accessKey != "second" {
+		t.Errorf("unexpected access key: %s", accessKey)
+	}
+	cancel()
+	for watch_err := range err_chan {
+		if watch_err == context.Canceled {
+			break
+		}
+	}
+
+	// credentials that have expired are not served, but the file names are kept
+	write(good("expired", time.Now().Add(-time.Minute)))
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	write(`{}`)
+	rr_err := rf.RolesRead()
+	if _, degraded := rr_err.(*DegradedError); rr_err == nil || degraded {
+		t.Errorf("expected a plain error for expired credentials: %v", rr_err)
+	}
+	if !rf.IsEmpty() || rf.JSONFile != "role.json" {
+		t.Errorf("expired credentials should be zeroed without forgetting the file")
+	}
+}
+
+func TestValidMtimeRange(t *testing.T) {
+	now := time.Now()
+	ts := []time.Time{now, now.Add(-5 * time.Second), now.Add(-2 * time.Second)}
+	if !valid_mtime_range(ts, DEFAULT_MAX_MTIME_SKEW) {
+		t.Errorf("5s skew should be valid by default")
+	}
+	if valid_mtime_range(ts, 3*time.Second) {
+		t.Errorf("5s skew should not be valid within 3s")
+	}
+}
+
+func TestRolesWatchSettle(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_files")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	json_path := filepath.Join(dir, "role.json")
+	complete := `{"AccessKeyId":"settled","SecretAccessKey":"secret","Token":"token"}`
+	ioutil.WriteFile(json_path, []byte(complete), 0600)
+
+	rf := NewRolesFiles()
+	rf.BaseDir = dir
+	rf.JSONFile = "role.json"
+	rf.SettleInterval = 500 * time.Millisecond
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	events, unsubscribe := rf.Subscribe(100)
+	defer unsubscribe()
+	ctx, cancel := context.WithCancel(context.Background())
+	err_chan := make(chan error, 10)
+	go rf.RolesWatchContext(ctx, err_chan, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	// a slow writer: the partial document must never be read
+	f, f_err := os.Create(json_path)
+	if f_err != nil {
+		t.Fatal(f_err.Error())
+	}
+	for i := 0; i < len(complete); i += 10 {
+		end := i + 10
+		if end > len(complete) {
+			end = len(complete)
+		}
+		f.WriteString(complete[i:end])
+		time.Sleep(100 * time.Millisecond)
+	}
+	f.Close()
+
+	select {
+	case ev := <-events:
+		if ev.Type != roles.Rotated {
+			t.Errorf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the settled read")
+	}
+	cancel()
+	if watch_err := <-err_chan; watch_err != context.Canceled {
+		t.Errorf("unexpected watch error: %v", watch_err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected one read after the writes settled, got %d more events", len(events))
+	}
+}
+
+func TestRolesWatchPoll(t *testing.T) {
+	for _, mode := range []WatchMode{WATCH_POLL, WATCH_BOTH} {
+		dir, dir_err := ioutil.TempDir("", "roles_files")
+		if dir_err != nil {
+			t.Fatal(dir_err.Error())
+		}
+		defer os.RemoveAll(dir)
+		write := func(suffix string) {
+			for _, name := range []string{"role_access_key", "role_secret_key", "role_token"} {
+				ioutil.WriteFile(filepath.Join(dir, name), []byte(name+suffix), 0600)
+			}
+		}
+		write("-first")
+
+		rf := NewRolesFiles()
+		rf.BaseDir = dir
+		rf.AccessKeyFile = "role_access_key"
+		rf.SecretFile = "role_secret_key"
+		rf.TokenFile = "role_token"
+		rf.WatchMode = mode
+		rf.PollInterval = 100 * time.Millisecond
+		rf.SettleInterval = 200 * time.Millisecond
+		if rr_err := rf.RolesRead(); rr_err != nil {
+			t.Fatal(rr_err.Error())
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		err_chan := make(chan error, 10)
+		read_signal := make(chan bool, 10)
+		go rf.RolesWatchContext(ctx, err_chan, read_signal)
+		time.Sleep(300 * time.Millisecond)
+
+		write("-second")
+		select {
+		case <-read_signal:
+		case watch_err := <-err_chan:
+			t.Fatalf("mode %d: unexpected watch error: %v", mode, watch_err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("mode %d: timed out waiting for a polled read", mode)
+		}
+		if accessKey, _ := rf.GetAccessKey(); accessKey != "role_access_key-second" {
+			t.Errorf("mode %d: unexpected access key: %s", mode, accessKey)
+		}
+		// the change was read once; polling must not find it again
+		time.Sleep(time.Second)
+		if len(read_signal) != 0 {
+			t.Errorf("mode %d: the same change was read %d more times", mode, len(read_signal))
+		}
+		cancel()
+		if watch_err := <-err_chan; watch_err != context.Canceled {
+			t.Errorf("mode %d: unexpected final watch value: %v", mode, watch_err)
+		}
+	}
+}
+
+// publish writes a generation of role files the way the Kubernetes atomic writer does:
+// into a new directory, then swaps the ..data symlink to it.
+func publish(t *testing.T, dir, generation string, mtime_skew time.Duration) {
+	gen_dir := filepath.Join(dir, "..gen_"+generation)
+	if mkdir_err := os.Mkdir(gen_dir, 0700); mkdir_err != nil {
+		t.Fatal(mkdir_err.Error())
+	}
+	mtime := time.Now()
+	for _, name := range []string{"role_access_key", "role_secret_key", "role_token"} {
+		p := filepath.Join(gen_dir, name)
+		ioutil.WriteFile(p, []byte(name+"-"+generation), 0600)
+		os.Chtimes(p, mtime, mtime)
+		mtime = mtime.Add(-mtime_skew)
+		// the files in BaseDir point through ..data, and are created once
+		os.Symlink(filepath.Join(ATOMIC_DATA_DIR, name), filepath.Join(dir, name))
+	}
+	old, _ := os.Readlink(filepath.Join(dir, ATOMIC_DATA_DIR))
+	if link_err := os.Symlink("..gen_"+generation, filepath.Join(dir, "..data_tmp")); link_err != nil {
+		t.Fatal(link_err.Error())
+	}
+	if rename_err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, ATOMIC_DATA_DIR)); rename_err != nil {
+		t.Fatal(rename_err.Error())
+	}
+	if old != "" {
+		os.RemoveAll(filepath.Join(dir, old))
+	}
+}
+
+func TestRolesWatchAtomicSwap(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_files")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	// the mtimes are well outside MaxMtimeSkew, which a swap makes irrelevant
+	publish(t, dir, "1", time.Hour)
+
+	rf := NewRolesFiles()
+	rf.BaseDir = dir
+	rf.AccessKeyFile = "role_access_key"
+	rf.SecretFile = "role_secret_key"
+	rf.TokenFile = "role_token"
+	rf.SettleInterval = 100 * time.Millisecond
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	if accessKey, _ := rf.GetAccessKey(); accessKey != "role_access_key-1" {
+		t.Errorf("unexpected access key: %s", accessKey)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err_chan := make(chan error, 10)
+	read_signal := make(chan bool, 10)
+	go rf.RolesWatchContext(ctx, err_chan, read_signal)
+	time.Sleep(100 * time.Millisecond)
+
+	publish(t, dir, "2", time.Hour)
+	select {
+	case <-read_signal:
+	case watch_err := <-err_chan:
+		t.Fatalf("unexpected watch error: %v", watch_err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the swap to be read")
+	}
+	accessKey, secret, token, get_err := rf.Get()
+	if get_err != nil || accessKey != "role_access_key-2" || secret != "role_secret_key-2" ||
+		token != "role_token-2" {
+		t.Errorf("unexpected role data after swap: %s %s %s %v", accessKey, secret, token, get_err)
+	}
+	cancel()
+	if watch_err := <-err_chan; watch_err != context.Canceled {
+		t.Errorf("unexpected final watch value: %v", watch_err)
+	}
+}
+
+func TestRolesWatchExactPaths(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_files")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	// "key" is a substring of "secret_key", which strings.Contains matching confused
+	names := []string{"key", "secret_key", "session_token"}
+	write := func(name, content string) {
+		if write_err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); write_err != nil {
+			t.Fatal(write_err.Error())
+		}
+	}
+	rename := func(from, to string) {
+		if rename_err := os.Rename(filepath.Join(dir, from), filepath.Join(dir, to)); rename_err != nil {
+			t.Fatal(rename_err.Error())
+		}
+	}
+	for _, name := range names {
+		write(name, name+"-0")
+	}
+
+	rf := NewRolesFiles()
+	rf.BaseDir = dir
+	rf.AccessKeyFile = names[0]
+	rf.SecretFile = names[1]
+	rf.TokenFile = names[2]
+	rf.SettleInterval = 100 * time.Millisecond
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err_chan := make(chan error, 10)
+	read_signal := make(chan bool, 10)
+	go rf.RolesWatchContext(ctx, err_chan, read_signal)
+	time.Sleep(100 * time.Millisecond)
+
+	expect_read := func(step, generation string) {
+		select {
+		case <-read_signal:
+		case watch_err := <-err_chan:
+			t.Fatalf("%s: unexpected watch error: %v", step, watch_err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for a read", step)
+		}
+		accessKey, secret, token, _ := rf.Get()
+		if accessKey != names[0]+generation || secret != names[1]+generation || token != names[2]+generation {
+			t.Errorf("%s: unexpected role data: %s %s %s", step, accessKey, secret, token)
+		}
+	}
+	expect_no_read := func(step string) {
+		select {
+		case <-read_signal:
+			t.Errorf("%s: unexpected read", step)
+		case watch_err := <-err_chan:
+			t.Errorf("%s: unexpected watch error: %v", step, watch_err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	// neighbouring files are not the role files
+	for _, name := range names {
+		write(name+".tmp", "decoy")
+		write("old_"+name, "decoy")
+		write("."+name+".swp", "decoy")
+	}
+	expect_no_read("decoys")
+
+	// secret_key must not also count as key
+	write(names[1], names[1]+"-0")
+	write(names[2], names[2]+"-0")
+	expect_no_read("substring")
+	write(names[0], names[0]+"-0")
+	expect_read("substring", "-0")
+
+	// writers that rename a finished temp file into place
+	for _, name := range names {
+		write(name+".tmp", name+"-1")
+		rename(name+".tmp", name)
+	}
+	expect_read("rename into place", "-1")
+
+	// editors that move the original to a backup and write a new file
+	for _, name := range names {
+		rename(name, name+"~")
+		write(name, name+"-2")
+		os.Remove(filepath.Join(dir, name+"~"))
+	}
+	expect_read("editor backup", "-2")
+}
+
+func TestRolePath(t *testing.T) {
+	rf := NewRolesFiles()
+	rf.BaseDir = "/etc/aws"
+	for name, ok := range map[string]bool{
+		"role_token":           true,
+		"sub/role_token":       true,
+		"sub/../role_token":    true,
+		"../role_token":        false,
+		"sub/../../etc/shadow": false,
+		"..":                   false,
+		"":                     false,
+		"/run/aws/role_token":  true,
+	} {
+		_, path_err := rf.rolePath("TokenFile", name)
+		if (path_err == nil) != ok {
+			t.Errorf("%q: expected ok %v, got %v", name, ok, path_err)
+		}
+	}
+	rf.AllowedRoot = "/run"
+	if _, path_err := rf.rolePath("TokenFile", "/run/aws/role_token"); path_err != nil {
+		t.Error(path_err.Error())
+	}
+	if _, path_err := rf.rolePath("TokenFile", "role_token"); path_err == nil {
+		t.Errorf("expected BaseDir outside AllowedRoot to be rejected")
+	}
+	if _, path_err := rf.rolePath("TokenFile", "/run/../etc/aws/role_token"); path_err == nil {
+		t.Errorf("expected traversal out of AllowedRoot to be rejected")
+	}
+	rf.BaseDir = ""
+	if _, path_err := rf.rolePath("TokenFile", "role_token"); path_err == nil {
+		t.Errorf("expected a relative name without BaseDir to be rejected")
+	}
+}
+
+func TestRolesWatchSeparateDirs(t *testing.T) {
+	root, root_err := ioutil.TempDir("", "roles_files")
+	if root_err != nil {
+		t.Fatal(root_err.Error())
+	}
+	defer os.RemoveAll(root)
+	// e.g. the key on a persistent volume and the token on tmpfs
+	paths := make([]string, 0)
+	for _, dir := range []string{"persistent", "secrets", "tmpfs"} {
+		os.Mkdir(filepath.Join(root, dir), 0700)
+		paths = append(paths, filepath.Join(root, dir, "role_"+dir))
+	}
+	write := func(generation string) {
+		for _, p := range paths {
+			ioutil.WriteFile(p, []byte(filepath.Base(p)+generation), 0600)
+		}
+	}
+	write("-1")
+
+	rf := NewRolesFiles()
+	rf.AccessKeyFile = paths[0]
+	rf.SecretFile = paths[1]
+	rf.TokenFile = paths[2]
+	rf.AllowedRoot = root
+	rf.SettleInterval = 100 * time.Millisecond
+	if rr_err := rf.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err_chan := make(chan error, 10)
+	read_signal := make(chan bool, 10)
+	go rf.RolesWatchContext(ctx, err_chan, read_signal)
+	time.Sleep(100 * time.Millisecond)
+
+	write("-2")
+	select {
+	case <-read_signal:
+	case watch_err := <-err_chan:
+		t.Fatalf("unexpected watch error: %v", watch_err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a read")
+	}
+	accessKey, secret, token, _ := rf.Get()
+	if accessKey != "role_persistent-2" || secret != "role_secrets-2" || token != "role_tmpfs-2" {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+	cancel()
+	if watch_err := <-err_chan; watch_err != context.Canceled {
+		t.Errorf("unexpected final watch value: %v", watch_err)
+	}
+
+	// a file outside AllowedRoot is refused
+	rf.AccessKeyFile = paths[0]
+	rf.SecretFile = paths[1]
+	rf.TokenFile = paths[2]
+	rf.AllowedRoot = filepath.Join(root, "tmpfs")
+	if rf.RolesRead() == nil {
+		t.Errorf("expected files outside AllowedRoot to be refused")
+	}
+}
+
+func TestRolesFilesEnforcePermissions(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_files")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	outside, outside_err := ioutil.TempDir("", "roles_files_outside")
+	if outside_err != nil {
+		t.Fatal(outside_err.Error())
+	}
+	defer os.RemoveAll(outside)
+	names := []string{"role_access_key", "role_secret_key", "role_token"}
+	for _, name := range names {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600)
+	}
+
+	rf := NewRolesFiles()
+	rf.BaseDir = dir
+	rf.AccessKeyFile = names[0]
+	rf.SecretFile = names[1]
+	rf.TokenFile = names[2]
+	rf.EnforcePermissions = true
+	rf.OwnerUID = os.Getuid()
+	rf.OwnerGID = os.Getgid()
+	read := func() error {
+		rf.AccessKeyFile = names[0]
+		rf.SecretFile = names[1]
+		rf.TokenFile = names[2]
+		return rf.RolesRead()
+	}
+	if rr_err := read(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+
+	token_path := filepath.Join(dir, names[2])
+	os.Chmod(token_path, 0640)
+	if rr_err := read(); rr_err == nil || !strings.Contains(rr_err.Error(), "group or world readable") {
+		t.Errorf("expected a group readable file to be refused: %v", rr_err)
+	}
+	os.Chmod(token_path, 0604)
+	if rr_err := read(); rr_err == nil {
+		t.Errorf("expected a world readable file to be refused")
+	}
+	os.Chmod(token_path, 0400)
+
+	rf.OwnerUID = os.Getuid() + 1
+	if rr_err := read(); rr_err == nil || !strings.Contains(rr_err.Error(), "owned by uid") {
+		t.Errorf("expected an unexpected owner to be refused: %v", rr_err)
+	}
+	rf.OwnerUID = -1
+	rf.OwnerGID = os.Getgid() + 1
+	if rr_err := read(); rr_err == nil || !strings.Contains(rr_err.Error(), "owned by gid") {
+		t.Errorf("expected an unexpected group to be refused: %v", rr_err)
+	}
+	rf.OwnerGID = -1
+
+	// a symlink out of BaseDir is refused, one within it is followed
+	ioutil.WriteFile(filepath.Join(outside, "stolen"), []byte("stolen"), 0600)
+	os.Remove(token_path)
+	os.Symlink(filepath.Join(outside, "stolen"), token_path)
+	if rr_err := read(); rr_err == nil || !strings.Contains(rr_err.Error(), "outside") {
+		t.Errorf("expected a symlink outside BaseDir to be refused: %v", rr_err)
+	}
+	os.Remove(token_path)
+	ioutil.WriteFile(filepath.Join(dir, "token_target"), []byte("linked"), 0600)
+	os.Symlink("token_target", token_path)
+	if rr_err := read(); rr_err != nil {
+		t.Error(rr_err.Error())
+	}
+	if token, _ := rf.GetToken(); token != "linked" {
+		t.Errorf("unexpected token: %s", token)
+	}
+
+	// without EnforcePermissions nothing is checked
+	os.Chmod(filepath.Join(dir, "token_target"), 0644)
+	rf.EnforcePermissions = false
+	if rr_err := read(); rr_err != nil {
+		t.Error(rr_err.Error())
 	}
 }
 
@@ -127,6 +874,6 @@ func TestMissingRolesFiles(t *testing.T) {
 	rf := roles.RolesReader(rf_)
 	rr_err := rf.RolesRead()
 	if rr_err == nil {
-		t.Errorf(rr_err.Error())
+		t.Errorf("expected an error reading missing roles files")
 	}
 }
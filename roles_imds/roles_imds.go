@@ -0,0 +1,308 @@
+// Implements the RolesReader interface (roles.go) by fetching role credentials directly from the
+// EC2 instance metadata service using IMDSv2 session tokens. This removes the need for another
+// process to fetch credentials and deposit files for RolesFiles.
+//
+package roles_imds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "imds"
+
+	// DEFAULT_ENDPOINT is the address of the instance metadata service.
+	DEFAULT_ENDPOINT = "http://169.254.169.254"
+	// ENDPOINT_ENV may be set to override DEFAULT_ENDPOINT.
+	ENDPOINT_ENV = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+
+	TOKEN_PATH       = "/latest/api/token"
+	CREDENTIALS_PATH = "/latest/meta-data/iam/security-credentials/"
+	TOKEN_HEADER     = "X-aws-ec2-metadata-token"
+	TOKEN_TTL_HEADER = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	// DEFAULT_TOKEN_TTL is the lifetime requested for IMDSv2 session tokens.
+	DEFAULT_TOKEN_TTL = 6 * time.Hour
+	// DEFAULT_TIMEOUT bounds each request to the metadata service.
+	DEFAULT_TIMEOUT = 5 * time.Second
+)
+
+// RolesIMDS fetches credentials for an instance profile role from the metadata service.
+type RolesIMDS struct {
+	// Endpoint is the base URL of the metadata service. If empty, ENDPOINT_ENV or
+	// DEFAULT_ENDPOINT is used.
+	Endpoint string
+	// RoleName is the instance profile role. If empty it is discovered on each read.
+	RoleName string
+	// Client is used for requests to the metadata service.
+	Client *http.Client
+	// Refresher controls how far ahead of Expiration RolesWatch fetches new credentials.
+	Refresher roles.Refresher
+
+	token            string
+	token_expiration time.Time
+	fetch_lock       sync.Mutex
+	roleFields       *roles.RolesFields
+	lock             sync.RWMutex
+}
+
+// NewRolesIMDS returns a pointer to a RolesIMDS instance.
+func NewRolesIMDS() *RolesIMDS {
+	r := new(RolesIMDS)
+	r.Client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	r.roleFields = roles.NewRolesFields()
+	return r
+}
+
+// ProviderType is a descriptive string of the implementation.
+func (rf *RolesIMDS) ProviderType() string {
+	return ROLE_PROVIDER
+}
+
+// UsingIAM tells us if the credentials provided by this role are temporary credentials which
+// also have a Token component, or if they are durable key/secret-only credentials.
+func (rf *RolesIMDS) UsingIAM() bool {
+	return true
+}
+
+// IsEmpty determines if a RolesIMDS struct is uninitialized.
+func (rf *RolesIMDS) IsEmpty() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsEmpty()
+}
+
+// ZeroRoles recreate the RolesIMDS credentials as initialized by NewRolesIMDS.
+func (rf *RolesIMDS) ZeroRoles() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.lock.Unlock()
+}
+
+// RolesRead populates rolesFields with a blocking fetch from the metadata service.
+func (rf *RolesIMDS) RolesRead() error {
+	roles_err := rf.rolesIMDSRead()
+	if roles_err != nil {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. It fetches from the instance metadata service like
+// RolesRead, but on failure the current credentials are kept.
+func (rf *RolesIMDS) RolesReread() error {
+	return rf.rolesIMDSRead()
+}
+
+// RolesWatch fetches new credentials ahead of their Expiration. See RolesWatchContext.
+func (rf *RolesIMDS) RolesWatch(err_chan chan error, read_signal chan bool) {
+	rf.RolesWatchContext(context.Background(), err_chan, read_signal)
+}
+
+// RolesWatchContext fetches new credentials ahead of their Expiration until ctx is done,
+// signalling each refresh on read_signal. Failed fetches are sent on err_chan and retried,
+// leaving the current credentials in place until they expire. ctx.Err() is the final value
+// sent on err_chan.
+func (rf *RolesIMDS) RolesWatchContext(ctx context.Context, err_chan chan error, read_signal chan bool) {
+	log.Printf("initiate roles watching\n")
+	rf.Refresher.Watch(ctx, err_chan, read_signal, rf.rolesIMDSRead, rf.ExpiresAt)
+	log.Printf("terminating roles watching\n")
+}
+
+// ExpiresAt returns the expiration of the current credentials, and false if it is not known.
+func (rf *RolesIMDS) ExpiresAt() (time.Time, bool) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.ExpiresAt()
+}
+
+// IsExpired reports whether the current credentials expire within skew of now.
+func (rf *RolesIMDS) IsExpired(skew time.Duration) bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsExpired(skew)
+}
+
+// Get returns the (accessKey,secret,token), or an error.
+func (rf *RolesIMDS) Get() (string, string, string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	accessKey := ""
+	if rf.roleFields.AccessKey == "" {
+		return "", "", "", errors.New("roles_imds.Get: empty AccessKey")
+	} else {
+		accessKey = rf.roleFields.AccessKey
+	}
+	secret := ""
+	if rf.roleFields.Secret == "" {
+		return "", "", "", errors.New("roles_imds.Get: empty Secret")
+	} else {
+		secret = rf.roleFields.Secret
+	}
+	token := ""
+	if rf.roleFields.Token == "" {
+		return "", "", "", errors.New("roles_imds.Get: empty Token")
+	} else {
+		token = rf.roleFields.Token
+	}
+	return accessKey, secret, token, nil
+}
+
+// GetAccessKey returns the accessKey or an error.
+func (rf *RolesIMDS) GetAccessKey() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.AccessKey == "" {
+		return "", errors.New("roles_imds.GetAccessKey: empty AccessKey")
+	} else {
+		return rf.roleFields.AccessKey, nil
+	}
+}
+
+// GetSecret returns the secret or an error.
+func (rf *RolesIMDS) GetSecret() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Secret == "" {
+		return "", errors.New("roles_imds.GetSecret: empty Secret")
+	} else {
+		return rf.roleFields.Secret, nil
+	}
+}
+
+// GetToken returns the token or an error.
+func (rf *RolesIMDS) GetToken() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Token == "" {
+		return "", errors.New("roles_imds.GetToken: empty Token")
+	} else {
+		return rf.roleFields.Token, nil
+	}
+}
+
+func (rf *RolesIMDS) endpoint() string {
+	if rf.Endpoint != "" {
+		return strings.TrimRight(rf.Endpoint, "/")
+	}
+	if e := os.Getenv(ENDPOINT_ENV); e != "" {
+		return strings.TrimRight(e, "/")
+	}
+	return DEFAULT_ENDPOINT
+}
+
+// imds_do performs req and returns the body of a 200 response.
+func (rf *RolesIMDS) imds_do(req *http.Request) ([]byte, error) {
+	client := rf.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, resp_err := client.Do(req)
+	if resp_err != nil {
+		e := fmt.Sprintf("roles_imds: %s %s: %s", req.Method, req.URL.Path, resp_err.Error())
+		return nil, errors.New(e)
+	}
+	defer resp.Body.Close()
+	body, body_err := ioutil.ReadAll(resp.Body)
+	if body_err != nil {
+		e := fmt.Sprintf("roles_imds: %s %s: read err: %s", req.Method, req.URL.Path, body_err.Error())
+		return nil, errors.New(e)
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := fmt.Sprintf("roles_imds: %s %s: status %d", req.Method, req.URL.Path, resp.StatusCode)
+		return nil, errors.New(e)
+	}
+	return body, nil
+}
+
+// session_token returns a cached IMDSv2 session token, fetching a new one via PUT when the
+// cached one is missing or close to expiring. The caller must hold fetch_lock.
+func (rf *RolesIMDS) session_token() (string, error) {
+	if rf.token != "" && time.Now().Add(time.Minute).Before(rf.token_expiration) {
+		return rf.token, nil
+	}
+	req, req_err := http.NewRequest("PUT", rf.endpoint()+TOKEN_PATH, nil)
+	if req_err != nil {
+		return "", req_err
+	}
+	ttl := int(DEFAULT_TOKEN_TTL / time.Second)
+	req.Header.Set(TOKEN_TTL_HEADER, fmt.Sprintf("%d", ttl))
+	body, body_err := rf.imds_do(req)
+	if body_err != nil {
+		return "", body_err
+	}
+	token := strings.TrimSpace(string(body))
+	if token == "" {
+		return "", errors.New("roles_imds.session_token: empty session token")
+	}
+	rf.token = token
+	rf.token_expiration = time.Now().Add(DEFAULT_TOKEN_TTL)
+	return token, nil
+}
+
+// imds_get issues a GET for path with the session token. The caller must hold fetch_lock.
+func (rf *RolesIMDS) imds_get(path string) ([]byte, error) {
+	token, token_err := rf.session_token()
+	if token_err != nil {
+		return nil, token_err
+	}
+	req, req_err := http.NewRequest("GET", rf.endpoint()+path, nil)
+	if req_err != nil {
+		return nil, req_err
+	}
+	req.Header.Set(TOKEN_HEADER, token)
+	body, body_err := rf.imds_do(req)
+	if body_err != nil {
+		// the session token may have been invalidated; fetch a new one next time
+		rf.token = ""
+		return nil, body_err
+	}
+	return body, nil
+}
+
+// will fetch the role name if needed, then the role credentials, and swap them in at once.
+// readers are only blocked for the swap, not for the requests.
+func (rf *RolesIMDS) rolesIMDSRead() error {
+	rf.fetch_lock.Lock()
+	defer rf.fetch_lock.Unlock()
+	role_name := rf.RoleName
+	if role_name == "" {
+		names, names_err := rf.imds_get(CREDENTIALS_PATH)
+		if names_err != nil {
+			return names_err
+		}
+		role_name = strings.TrimSpace(strings.SplitN(string(names), "\n", 2)[0])
+		if role_name == "" {
+			return errors.New("roles_imds.rolesIMDSRead: no instance profile role found")
+		}
+	}
+	creds, creds_err := rf.imds_get(CREDENTIALS_PATH + role_name)
+	if creds_err != nil {
+		return creds_err
+	}
+	fields, parse_err := roles.ParseRolesJSON(creds)
+	if parse_err != nil {
+		e := fmt.Sprintf("roles_imds.rolesIMDSRead: %s: %s", role_name, parse_err.Error())
+		return errors.New(e)
+	}
+	if fields.Token == "" {
+		e := fmt.Sprintf("roles_imds.rolesIMDSRead: %s: empty Token", role_name)
+		return errors.New(e)
+	}
+	rf.lock.Lock()
+	*rf.roleFields = *fields
+	rf.lock.Unlock()
+	log.Printf("roles_imds.rolesIMDSRead: succesful assignment of role data\n")
+	return nil
+}
@@ -0,0 +1,129 @@
+package roles_imds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake_imds is a stand-in for the metadata service that hands out credentials expiring after
+// ttl, with a new AccessKeyId on every fetch.
+type fake_imds struct {
+	ttl     time.Duration
+	fetches int
+	lock    sync.Mutex
+}
+
+func (f *fake_imds) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "PUT" && r.URL.Path == TOKEN_PATH:
+		if r.Header.Get(TOKEN_TTL_HEADER) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "session-token")
+	case r.Header.Get(TOKEN_HEADER) != "session-token":
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.Method == "GET" && r.URL.Path == CREDENTIALS_PATH:
+		fmt.Fprint(w, "test-role\n")
+	case r.Method == "GET" && r.URL.Path == CREDENTIALS_PATH+"test-role":
+		f.lock.Lock()
+		f.fetches++
+		n := f.fetches
+		f.lock.Unlock()
+		json.NewEncoder(w).Encode(roles.RolesJSON{
+			Code:            "Success",
+			AccessKeyId:     fmt.Sprintf("accesskey%d", n),
+			SecretAccessKey: "secretkey",
+			Token:           "token",
+			Expiration:      time.Now().Add(f.ttl).UTC().Format(time.RFC3339),
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRolesIMDS(t *testing.T) {
+	ts := httptest.NewServer(&fake_imds{ttl: time.Hour})
+	defer ts.Close()
+
+	ri := NewRolesIMDS()
+	ri.Endpoint = ts.URL
+	if !ri.IsEmpty() {
+		t.Errorf("new RolesIMDS is not empty?")
+	}
+	rr_err := roles.RolesReader(ri).RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, token, get_err := ri.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "accesskey1" || secret != "secretkey" || token != "token" {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+	if ri.IsExpired(time.Minute) {
+		t.Errorf("credentials should not be expired")
+	}
+	if !ri.IsExpired(2 * time.Hour) {
+		t.Errorf("credentials should be expired with a two hour skew")
+	}
+}
+
+func TestRolesIMDSUnavailable(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	ri := NewRolesIMDS()
+	ri.Endpoint = ts.URL
+	if ri.RolesRead() == nil {
+		t.Errorf("expected an error without a metadata service")
+	}
+	if !ri.IsEmpty() {
+		t.Errorf("failed read should leave RolesIMDS empty")
+	}
+}
+
+func TestRolesIMDSWatch(t *testing.T) {
+	// credentials expire in two seconds and are refreshed one second ahead
+	ts := httptest.NewServer(&fake_imds{ttl: 2 * time.Second})
+	defer ts.Close()
+
+	ri := NewRolesIMDS()
+	ri.Endpoint = ts.URL
+	ri.Refresher.Window = time.Second
+	rr_err := ri.RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan error)
+	s := make(chan bool)
+	go ri.RolesWatchContext(ctx, c, s)
+
+	select {
+	case <-s:
+		accessKey, _ := ri.GetAccessKey()
+		if accessKey == "accesskey1" {
+			t.Errorf("credentials were not refreshed")
+		}
+	case watch_err := <-c:
+		t.Errorf("error from watcher: %v", watch_err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("no refresh before expiration")
+	}
+	cancel()
+	for watch_err := range c {
+		if watch_err == context.Canceled {
+			break
+		}
+	}
+}
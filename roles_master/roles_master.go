@@ -6,6 +6,7 @@ import (
 	"errors"
 	roles "github.com/smugmug/goawsroles/roles"
 	"sync"
+	"time"
 )
 
 const (
@@ -43,9 +44,12 @@ func (rf *RolesMaster) UsingIAM() bool {
 	return false
 }
 
-// IsEmpty determines if a RolesMaster struct is uninitialized.
+// IsEmpty determines if a RolesMaster struct is uninitialized. Master credentials have no
+// Token, so only the AccessKey and Secret are considered.
 func (rf *RolesMaster) IsEmpty() bool {
-	return rf.roleFields.IsEmpty()
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.AccessKey == "" || rf.roleFields.Secret == ""
 }
 
 // ZeroRoles recreate the RolesMaster as initialized by NewRolesMaster
@@ -65,6 +69,16 @@ func (rf *RolesMaster) RolesWatch(err_chan chan error, read_signal chan bool) {
 	panic("RolesWatch not defined for RolesMaster as credentials are immutable")
 }
 
+// ExpiresAt always returns false as master credentials do not expire.
+func (rf *RolesMaster) ExpiresAt() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// IsExpired always returns false as master credentials do not expire.
+func (rf *RolesMaster) IsExpired(skew time.Duration) bool {
+	return false
+}
+
 // Get returns the (accessKey,secret,token), or an error.
 func (rf *RolesMaster) Get() (string, string, string, error) {
 	rf.lock.RLock()
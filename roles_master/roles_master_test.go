@@ -0,0 +1,34 @@
+package roles_master
+
+import (
+	roles "github.com/smugmug/goawsroles/roles"
+	"testing"
+)
+
+func TestRolesMasterIsEmpty(t *testing.T) {
+	rm := NewRolesMaster("accesskey", "secretkey")
+	// master credentials never have a Token, which must not make them empty
+	if rm.IsEmpty() {
+		t.Errorf("RolesMaster with an access key and secret should not be empty")
+	}
+	accessKey, secret, token, get_err := roles.RolesReader(rm).Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "accesskey" || secret != "secretkey" || token != "" {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+	if !NewRolesMaster("accesskey", "").IsEmpty() {
+		t.Errorf("RolesMaster without a secret should be empty")
+	}
+	if !NewRolesMaster("", "secretkey").IsEmpty() {
+		t.Errorf("RolesMaster without an access key should be empty")
+	}
+	rm.ZeroRoles()
+	if !rm.IsEmpty() {
+		t.Errorf("RolesMaster should be empty after ZeroRoles")
+	}
+	if _, _, _, get_err := rm.Get(); get_err == nil {
+		t.Errorf("expected an error getting zeroed roles")
+	}
+}
@@ -0,0 +1,260 @@
+// Implements the RolesReader interface (roles.go) for the AWS credential_process contract: an
+// external command prints a JSON document with Version, AccessKeyId, SecretAccessKey,
+// SessionToken and Expiration on its standard output. This lets existing helper binaries, such as
+// SSO tooling, provide credentials without writing RolesFiles-format files.
+//
+package roles_process
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "process"
+
+	// PROCESS_VERSION is the only supported Version of the credential_process output.
+	PROCESS_VERSION = 1
+	// DEFAULT_TIMEOUT bounds each run of the command.
+	DEFAULT_TIMEOUT = time.Minute
+	// MAX_STDERR is the most stderr output included in an error.
+	MAX_STDERR = 1024
+	// WAIT_DELAY is how long to wait for stdout and stderr to close once the command has been
+	// killed. Children of the command that inherited them (e.g. `sh -c "helper &"`) would
+	// otherwise hold the read open past the Timeout.
+	WAIT_DELAY = time.Second
+)
+
+// RolesProcess runs Command to obtain credentials.
+type RolesProcess struct {
+	Command string
+	Args    []string
+	// Timeout bounds each run of Command. If zero, DEFAULT_TIMEOUT is used.
+	Timeout time.Duration
+	// Refresher controls how far ahead of Expiration RolesWatch runs Command again.
+	Refresher roles.Refresher
+
+	fetch_lock sync.Mutex
+	roleFields *roles.RolesFields
+	lock       sync.RWMutex
+}
+
+// NewRolesProcess returns a pointer to a RolesProcess instance that runs command with args.
+func NewRolesProcess(command string, args ...string) *RolesProcess {
+	r := new(RolesProcess)
+	r.Command = command
+	r.Args = args
+	r.Timeout = DEFAULT_TIMEOUT
+	r.roleFields = roles.NewRolesFields()
+	return r
+}
+
+// ProviderType is a descriptive string of the implementation.
+func (rf *RolesProcess) ProviderType() string {
+	return ROLE_PROVIDER
+}
+
+// UsingIAM tells us if the credentials provided by this role are temporary credentials which
+// also have a Token component, or if they are durable key/secret-only credentials. For this
+// package, that depends on whether the command returned a SessionToken.
+func (rf *RolesProcess) UsingIAM() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.Token != ""
+}
+
+// IsEmpty determines if a RolesProcess struct is uninitialized. The command may not return a
+// SessionToken, so only the AccessKey and Secret are considered.
+func (rf *RolesProcess) IsEmpty() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.AccessKey == "" || rf.roleFields.Secret == ""
+}
+
+// ZeroRoles recreate the RolesProcess credentials as initialized by NewRolesProcess.
+func (rf *RolesProcess) ZeroRoles() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.lock.Unlock()
+}
+
+// RolesRead populates rolesFields with a blocking run of the command.
+func (rf *RolesProcess) RolesRead() error {
+	roles_err := rf.rolesProcessRead()
+	if roles_err != nil {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. It runs Command like RolesRead, but on failure the
+// current credentials are kept.
+func (rf *RolesProcess) RolesReread() error {
+	return rf.rolesProcessRead()
+}
+
+// RolesWatch runs the command again ahead of Expiration. See RolesWatchContext.
+func (rf *RolesProcess) RolesWatch(err_chan chan error, read_signal chan bool) {
+	rf.RolesWatchContext(context.Background(), err_chan, read_signal)
+}
+
+// RolesWatchContext runs the command again ahead of Expiration, or every Refresher.Interval if
+// the command reports no Expiration, until ctx is done. Each refresh is signalled on
+// read_signal. Failed runs are sent on err_chan and retried, leaving the current credentials in
+// place until they expire. ctx.Err() is the final value sent on err_chan.
+func (rf *RolesProcess) RolesWatchContext(ctx context.Context, err_chan chan error, read_signal chan bool) {
+	log.Printf("initiate roles watching\n")
+	rf.Refresher.Watch(ctx, err_chan, read_signal, rf.rolesProcessRead, rf.ExpiresAt)
+	log.Printf("terminating roles watching\n")
+}
+
+// ExpiresAt returns the expiration of the current credentials, and false if it is not known.
+func (rf *RolesProcess) ExpiresAt() (time.Time, bool) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.ExpiresAt()
+}
+
+// IsExpired reports whether the current credentials expire within skew of now.
+func (rf *RolesProcess) IsExpired(skew time.Duration) bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsExpired(skew)
+}
+
+// Get returns the (accessKey,secret,token), or an error. The token is empty if UsingIAM is false.
+func (rf *RolesProcess) Get() (string, string, string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	accessKey := ""
+	if rf.roleFields.AccessKey == "" {
+		return "", "", "", errors.New("roles_process.Get: empty AccessKey")
+	} else {
+		accessKey = rf.roleFields.AccessKey
+	}
+	secret := ""
+	if rf.roleFields.Secret == "" {
+		return "", "", "", errors.New("roles_process.Get: empty Secret")
+	} else {
+		secret = rf.roleFields.Secret
+	}
+	return accessKey, secret, rf.roleFields.Token, nil
+}
+
+// GetAccessKey returns the accessKey or an error.
+func (rf *RolesProcess) GetAccessKey() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.AccessKey == "" {
+		return "", errors.New("roles_process.GetAccessKey: empty AccessKey")
+	} else {
+		return rf.roleFields.AccessKey, nil
+	}
+}
+
+// GetSecret returns the secret or an error.
+func (rf *RolesProcess) GetSecret() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Secret == "" {
+		return "", errors.New("roles_process.GetSecret: empty Secret")
+	} else {
+		return rf.roleFields.Secret, nil
+	}
+}
+
+// GetToken returns the token or an error.
+func (rf *RolesProcess) GetToken() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Token == "" {
+		return "", errors.New("roles_process.GetToken: empty Token")
+	} else {
+		return rf.roleFields.Token, nil
+	}
+}
+
+// stderr_summary trims and truncates stderr for inclusion in an error, removing any of the
+// secrets that the command may have echoed there.
+func stderr_summary(stderr []byte, secrets ...string) string {
+	s := strings.TrimSpace(string(stderr))
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.Replace(s, secret, "[REDACTED]", -1)
+		}
+	}
+	if len(s) > MAX_STDERR {
+		s = s[:MAX_STDERR] + "..."
+	}
+	if s == "" {
+		return ""
+	}
+	return ": stderr: " + s
+}
+
+// will run the command and swap its credentials in at once. stdout is never included in
+// errors as it may hold credentials.
+func (rf *RolesProcess) rolesProcessRead() error {
+	rf.fetch_lock.Lock()
+	defer rf.fetch_lock.Unlock()
+	if rf.Command == "" {
+		return errors.New("roles_process.rolesProcessRead: empty Command")
+	}
+	timeout := rf.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, rf.Command, rf.Args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = WAIT_DELAY
+	run_err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		e := fmt.Sprintf("roles_process.rolesProcessRead: %s timed out after %s%s",
+			rf.Command, timeout, stderr_summary(stderr.Bytes()))
+		return errors.New(e)
+	}
+	if run_err != nil {
+		e := fmt.Sprintf("roles_process.rolesProcessRead: %s: %s%s",
+			rf.Command, run_err.Error(), stderr_summary(stderr.Bytes()))
+		return errors.New(e)
+	}
+
+	var rj roles.RolesJSON
+	fields, parse_err := parse_process_output(stdout.Bytes(), &rj)
+	if parse_err != nil {
+		e := fmt.Sprintf("roles_process.rolesProcessRead: %s: %s%s", rf.Command, parse_err.Error(),
+			stderr_summary(stderr.Bytes(), rj.AccessKeyId, rj.SecretAccessKey, rj.SessionToken))
+		return errors.New(e)
+	}
+	rf.lock.Lock()
+	*rf.roleFields = *fields
+	rf.lock.Unlock()
+	log.Printf("roles_process.rolesProcessRead: succesful assignment of role data\n")
+	return nil
+}
+
+// parse_process_output decodes b into rj and validates it as credential_process output.
+func parse_process_output(b []byte, rj *roles.RolesJSON) (*roles.RolesFields, error) {
+	json_err := roles.DecodeRolesJSON(b, rj)
+	if json_err != nil {
+		return nil, json_err
+	}
+	if rj.Version != PROCESS_VERSION {
+		e := fmt.Sprintf("unsupported Version %d, want %d", rj.Version, PROCESS_VERSION)
+		return nil, errors.New(e)
+	}
+	return rj.RolesFields()
+}
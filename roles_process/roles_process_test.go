@@ -0,0 +1,88 @@
+package roles_process
+
+import (
+	roles "github.com/smugmug/goawsroles/roles"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRolesProcess(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	rp := NewRolesProcess("sh", "-c", `printf '{"Version": 1, "AccessKeyId": "processkey", `+
+		`"SecretAccessKey": "processsecret", "SessionToken": "processtoken", `+
+		`"Expiration": "`+expiration+`"}'`)
+	rr_err := roles.RolesReader(rp).RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, token, get_err := rp.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "processkey" || secret != "processsecret" || token != "processtoken" {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+	if !rp.UsingIAM() {
+		t.Errorf("a session token was returned, UsingIAM should be true")
+	}
+	if _, ok := rp.ExpiresAt(); !ok {
+		t.Errorf("expected a known expiration")
+	}
+}
+
+func TestRolesProcessVersion(t *testing.T) {
+	rp := NewRolesProcess("sh", "-c", `printf '{"Version": 2, "AccessKeyId": "processkey", `+
+		`"SecretAccessKey": "processsecret"}'; echo "leaked processsecret" >&2`)
+	rr_err := rp.RolesRead()
+	if rr_err == nil {
+		t.Fatal("expected an error for an unsupported Version")
+	}
+	if !strings.Contains(rr_err.Error(), "Version 2") {
+		t.Errorf("error does not mention the Version: %s", rr_err.Error())
+	}
+	if strings.Contains(rr_err.Error(), "processsecret") {
+		t.Errorf("error echoes a secret: %s", rr_err.Error())
+	}
+}
+
+func TestRolesProcessFailure(t *testing.T) {
+	rp := NewRolesProcess("sh", "-c", `echo '{"SecretAccessKey": "stdoutsecret"}'; `+
+		`echo "sso session expired" >&2; exit 3`)
+	rr_err := rp.RolesRead()
+	if rr_err == nil {
+		t.Fatal("expected an error from a failing command")
+	}
+	if !strings.Contains(rr_err.Error(), "sso session expired") {
+		t.Errorf("error does not include stderr: %s", rr_err.Error())
+	}
+	if strings.Contains(rr_err.Error(), "stdoutsecret") {
+		t.Errorf("error echoes stdout: %s", rr_err.Error())
+	}
+	if !rp.IsEmpty() {
+		t.Errorf("failed read should leave RolesProcess empty")
+	}
+}
+
+func TestRolesProcessTimeout(t *testing.T) {
+	rp := NewRolesProcess("sleep", "5")
+	rp.Timeout = 100 * time.Millisecond
+	rr_err := rp.RolesRead()
+	if rr_err == nil || !strings.Contains(rr_err.Error(), "timed out") {
+		t.Errorf("expected a timeout error, got %v", rr_err)
+	}
+}
+
+func TestRolesProcessTimeoutChildren(t *testing.T) {
+	// the background sleep keeps stdout open after sh itself is killed
+	rp := NewRolesProcess("sh", "-c", "sleep 5 & sleep 5; wait")
+	rp.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	rr_err := rp.RolesRead()
+	if rr_err == nil || !strings.Contains(rr_err.Error(), "timed out") {
+		t.Errorf("expected a timeout error, got %v", rr_err)
+	}
+	if elapsed := time.Since(start); elapsed > rp.Timeout+WAIT_DELAY+time.Second {
+		t.Errorf("RolesRead took %s, the Timeout was not enforced", elapsed)
+	}
+}
@@ -0,0 +1,43 @@
+package roles_shared
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// parse_ini reads the subset of INI used by the AWS shared credentials and config files:
+// [section] headers, key = value pairs, and full-line comments starting with # or ;.
+// Section and key names are lowercased and trimmed. Indented lines that continue a previous
+// value (as used for nested config settings) are skipped.
+func parse_ini(b []byte) map[string]map[string]string {
+	sections := make(map[string]map[string]string)
+	var current map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			name = strings.Join(strings.Fields(name), " ")
+			if _, ok := sections[name]; !ok {
+				sections[name] = make(map[string]string)
+			}
+			current = sections[name]
+			continue
+		}
+		if current == nil || raw[0] == ' ' || raw[0] == '\t' {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		current[key] = strings.TrimSpace(line[i+1:])
+	}
+	return sections
+}
@@ -0,0 +1,345 @@
+// Implements the RolesReader interface (roles.go) for a named profile in the AWS shared
+// credentials file (~/.aws/credentials) and config file (~/.aws/config). AWS_PROFILE,
+// AWS_SHARED_CREDENTIALS_FILE and AWS_CONFIG_FILE are honored.
+//
+package roles_shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	fsnotify "github.com/howeyc/fsnotify"
+	fswatch "github.com/smugmug/goawsroles/internal/fswatch"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "shared"
+
+	PROFILE_ENV          = "AWS_PROFILE"
+	LEGACY_PROFILE_ENV   = "AWS_DEFAULT_PROFILE"
+	CREDENTIALS_FILE_ENV = "AWS_SHARED_CREDENTIALS_FILE"
+	CONFIG_FILE_ENV      = "AWS_CONFIG_FILE"
+
+	DEFAULT_PROFILE = "default"
+)
+
+// RolesShared reads the credentials of Profile from CredentialsFile, falling back to ConfigFile.
+type RolesShared struct {
+	Profile         string
+	CredentialsFile string
+	ConfigFile      string
+	roleFields      *roles.RolesFields
+	lock            sync.RWMutex
+}
+
+// NewRolesShared returns a pointer to a RolesShared instance configured from the environment,
+// defaulting to the "default" profile in ~/.aws/credentials and ~/.aws/config.
+func NewRolesShared() *RolesShared {
+	r := new(RolesShared)
+	r.Profile = os.Getenv(PROFILE_ENV)
+	if r.Profile == "" {
+		r.Profile = os.Getenv(LEGACY_PROFILE_ENV)
+	}
+	if r.Profile == "" {
+		r.Profile = DEFAULT_PROFILE
+	}
+	home, _ := os.UserHomeDir()
+	r.CredentialsFile = os.Getenv(CREDENTIALS_FILE_ENV)
+	if r.CredentialsFile == "" && home != "" {
+		r.CredentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	r.ConfigFile = os.Getenv(CONFIG_FILE_ENV)
+	if r.ConfigFile == "" && home != "" {
+		r.ConfigFile = filepath.Join(home, ".aws", "config")
+	}
+	r.roleFields = roles.NewRolesFields()
+	return r
+}
+
+// ProviderType is a descriptive string of the implementation.
+func (rf *RolesShared) ProviderType() string {
+	return ROLE_PROVIDER
+}
+
+// UsingIAM tells us if the credentials provided by this role are temporary credentials which
+// also have a Token component, or if they are durable key/secret-only credentials. For this
+// package, that depends on whether the profile has an aws_session_token.
+func (rf *RolesShared) UsingIAM() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.Token != ""
+}
+
+// IsEmpty determines if a RolesShared struct is uninitialized. Profiles need not have a
+// session token, so only the AccessKey and Secret are considered.
+func (rf *RolesShared) IsEmpty() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.AccessKey == "" || rf.roleFields.Secret == ""
+}
+
+// ZeroRoles recreate the RolesShared credentials as initialized by NewRolesShared.
+func (rf *RolesShared) ZeroRoles() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.lock.Unlock()
+}
+
+// RolesRead populates rolesFields with a blocking read of the profile.
+func (rf *RolesShared) RolesRead() error {
+	roles_err := rf.rolesSharedRead()
+	if roles_err != nil {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. It reads the profile like RolesRead, but on failure
+// the current credentials are kept.
+func (rf *RolesShared) RolesReread() error {
+	return rf.rolesSharedRead()
+}
+
+// RolesWatch catches filesystem notify events to re-read the profile when either file is
+// edited. See RolesWatchContext.
+func (rf *RolesShared) RolesWatch(err_chan chan error, read_signal chan bool) {
+	rf.RolesWatchContext(context.Background(), err_chan, read_signal)
+}
+
+// RolesWatchContext re-reads the profile whenever fsnotify reports a change to CredentialsFile
+// or ConfigFile, until ctx is done. The directories holding the files are watched, so editors
+// that write a temporary file and rename it into place are seen. Each successful re-read is
+// signalled on read_signal, unless it is nil; a failed re-read zeroes the credentials and is
+// sent on err_chan. ctx.Err() is the final value sent on err_chan, or nil if the watcher shuts
+// down on its own.
+func (rf *RolesShared) RolesWatchContext(ctx context.Context, err_chan chan error, read_signal chan bool) {
+	log.Printf("initiate roles watching\n")
+	watcher, watcher_err := fsnotify.NewWatcher()
+	if watcher_err != nil {
+		err_chan <- watcher_err
+		return
+	}
+	paths := make(map[string]bool)
+	watched := 0
+	for _, f := range []string{rf.CredentialsFile, rf.ConfigFile} {
+		if f == "" {
+			continue
+		}
+		abs, abs_err := filepath.Abs(f)
+		if abs_err != nil {
+			continue
+		}
+		paths[abs] = true
+		if watcher.Watch(filepath.Dir(abs)) == nil {
+			watched++
+		}
+	}
+	if watched == 0 {
+		watcher.Close()
+		err_chan <- errors.New("roles_shared.RolesWatch: no credentials or config directory to watch")
+		return
+	}
+	final_err := func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ev, ok := <-watcher.Event:
+				if !ok {
+					return nil
+				}
+				if !(ev.IsModify() || ev.IsCreate()) {
+					continue
+				}
+				abs, abs_err := filepath.Abs(ev.Name)
+				if abs_err != nil || !paths[abs] {
+					continue
+				}
+				roles_err := rf.RolesRead()
+				if roles_err != nil {
+					log.Printf("roles_shared.RolesWatch: zeroing all roles on err:%s",
+						roles_err.Error())
+					select {
+					case err_chan <- roles_err:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					continue
+				}
+				log.Printf("roles_shared.RolesWatch: succesful re-read on %s\n", ev.String())
+				if read_signal == nil {
+					continue
+				}
+				select {
+				case read_signal <- true:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			case err, ok := <-watcher.Error:
+				if !ok {
+					return nil
+				}
+				select {
+				case err_chan <- err:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}()
+	watcher.Close()
+	go fswatch.Drain(watcher)
+	log.Printf("terminating roles watching\n")
+	err_chan <- final_err
+}
+
+// ExpiresAt always returns false as the shared files carry no expiration.
+func (rf *RolesShared) ExpiresAt() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// IsExpired always returns false as the shared files carry no expiration.
+func (rf *RolesShared) IsExpired(skew time.Duration) bool {
+	return false
+}
+
+// Get returns the (accessKey,secret,token), or an error. The token is empty if UsingIAM is false.
+func (rf *RolesShared) Get() (string, string, string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	accessKey := ""
+	if rf.roleFields.AccessKey == "" {
+		return "", "", "", errors.New("roles_shared.Get: empty AccessKey")
+	} else {
+		accessKey = rf.roleFields.AccessKey
+	}
+	secret := ""
+	if rf.roleFields.Secret == "" {
+		return "", "", "", errors.New("roles_shared.Get: empty Secret")
+	} else {
+		secret = rf.roleFields.Secret
+	}
+	return accessKey, secret, rf.roleFields.Token, nil
+}
+
+// GetAccessKey returns the accessKey or an error.
+func (rf *RolesShared) GetAccessKey() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.AccessKey == "" {
+		return "", errors.New("roles_shared.GetAccessKey: empty AccessKey")
+	} else {
+		return rf.roleFields.AccessKey, nil
+	}
+}
+
+// GetSecret returns the secret or an error.
+func (rf *RolesShared) GetSecret() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Secret == "" {
+		return "", errors.New("roles_shared.GetSecret: empty Secret")
+	} else {
+		return rf.roleFields.Secret, nil
+	}
+}
+
+// GetToken returns the token or an error.
+func (rf *RolesShared) GetToken() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Token == "" {
+		return "", errors.New("roles_shared.GetToken: empty Token")
+	} else {
+		return rf.roleFields.Token, nil
+	}
+}
+
+// read_sections returns the parsed file, or nil if it does not exist.
+func read_sections(path string) (map[string]map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, b_err := ioutil.ReadFile(path)
+	if b_err != nil {
+		if os.IsNotExist(b_err) {
+			return nil, nil
+		}
+		e := fmt.Sprintf("roles_shared.read_sections: %s read err: %s", path, b_err.Error())
+		return nil, errors.New(e)
+	}
+	return parse_ini(b), nil
+}
+
+// profileSection returns the settings of the profile. Credentials are never mixed between the
+// files: if the credentials file has an aws_access_key_id for the profile, that section is used
+// as a whole, and the config file's key, secret and token are ignored. Otherwise the config
+// file's section is used.
+func (rf *RolesShared) profileSection() (map[string]string, error) {
+	profile := rf.Profile
+	if profile == "" {
+		profile = DEFAULT_PROFILE
+	}
+	creds, creds_err := read_sections(rf.CredentialsFile)
+	if creds_err != nil {
+		return nil, creds_err
+	}
+	creds_section, creds_found := creds[profile]
+	if creds_found && creds_section["aws_access_key_id"] != "" {
+		return creds_section, nil
+	}
+	config, config_err := read_sections(rf.ConfigFile)
+	if config_err != nil {
+		return nil, config_err
+	}
+	// in the config file, profiles other than default are named "profile <name>"
+	config_names := []string{"profile " + profile}
+	if profile == DEFAULT_PROFILE {
+		config_names = append([]string{DEFAULT_PROFILE}, config_names...)
+	}
+	for _, name := range config_names {
+		if section, ok := config[name]; ok {
+			return section, nil
+		}
+	}
+	if creds_found {
+		return creds_section, nil
+	}
+	e := fmt.Sprintf("roles_shared.profileSection: profile %s not found in %s or %s",
+		profile, rf.CredentialsFile, rf.ConfigFile)
+	return nil, errors.New(e)
+}
+
+// will read in both files and swap the profile's credentials in at once.
+func (rf *RolesShared) rolesSharedRead() error {
+	settings, settings_err := rf.profileSection()
+	if settings_err != nil {
+		return settings_err
+	}
+	accessKey := settings["aws_access_key_id"]
+	if accessKey == "" {
+		e := fmt.Sprintf("roles_shared.rolesSharedRead: profile %s has no aws_access_key_id", rf.Profile)
+		return errors.New(e)
+	}
+	secret := settings["aws_secret_access_key"]
+	if secret == "" {
+		e := fmt.Sprintf("roles_shared.rolesSharedRead: profile %s has no aws_secret_access_key", rf.Profile)
+		return errors.New(e)
+	}
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.roleFields.AccessKey = accessKey
+	rf.roleFields.Secret = secret
+	rf.roleFields.Token = settings["aws_session_token"]
+	rf.lock.Unlock()
+	log.Printf("roles_shared.rolesSharedRead: succesful assignment of role data\n")
+	return nil
+}
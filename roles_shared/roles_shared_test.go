@@ -0,0 +1,227 @@
+package roles_shared
+
+import (
+	"context"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const test_credentials = `# developer credentials
+[default]
+aws_access_key_id = defaultkey
+aws_secret_access_key = defaultsecret
+
+[dev]
+aws_access_key_id=devkey
+aws_secret_access_key=devsecret
+aws_session_token=devtoken
+`
+
+const test_config = `[default]
+region = us-east-1
+
+[profile ops]
+region = us-west-2
+aws_access_key_id = opskey
+aws_secret_access_key = opssecret
+s3 =
+  max_concurrent_requests = 20
+`
+
+func write_test_files(t *testing.T) string {
+	dir, dir_err := ioutil.TempDir("", "roles_shared")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	if write_err := ioutil.WriteFile(filepath.Join(dir, "credentials"), []byte(test_credentials), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+	if write_err := ioutil.WriteFile(filepath.Join(dir, "config"), []byte(test_config), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+	return dir
+}
+
+func TestRolesShared(t *testing.T) {
+	dir := write_test_files(t)
+	defer os.RemoveAll(dir)
+	os.Setenv(CREDENTIALS_FILE_ENV, filepath.Join(dir, "credentials"))
+	os.Setenv(CONFIG_FILE_ENV, filepath.Join(dir, "config"))
+	os.Setenv(PROFILE_ENV, "dev")
+	defer os.Unsetenv(CREDENTIALS_FILE_ENV)
+	defer os.Unsetenv(CONFIG_FILE_ENV)
+	defer os.Unsetenv(PROFILE_ENV)
+
+	rs := NewRolesShared()
+	rr_err := roles.RolesReader(rs).RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, token, get_err := rs.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "devkey" || secret != "devsecret" || token != "devtoken" || !rs.UsingIAM() {
+		t.Errorf("unexpected dev profile data: %s %s %s", accessKey, secret, token)
+	}
+
+	rs.Profile = "default"
+	if rr_err = rs.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, _, token, _ = rs.Get()
+	if accessKey != "defaultkey" || token != "" || rs.UsingIAM() {
+		t.Errorf("unexpected default profile data: %s %s", accessKey, token)
+	}
+
+	// profiles only in the config file are read from [profile name]
+	rs.Profile = "ops"
+	if rr_err = rs.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, _ = rs.GetAccessKey()
+	if accessKey != "opskey" {
+		t.Errorf("unexpected ops profile data: %s", accessKey)
+	}
+
+	rs.Profile = "missing"
+	if rs.RolesRead() == nil {
+		t.Errorf("expected an error for a missing profile")
+	}
+}
+
+func TestRolesSharedWatch(t *testing.T) {
+	dir := write_test_files(t)
+	defer os.RemoveAll(dir)
+	rs := NewRolesShared()
+	rs.CredentialsFile = filepath.Join(dir, "credentials")
+	rs.ConfigFile = filepath.Join(dir, "config")
+	rs.Profile = "default"
+	if rr_err := rs.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan error)
+	s := make(chan bool)
+	go rs.RolesWatchContext(ctx, c, s)
+	time.Sleep(500 * time.Millisecond)
+
+	// edit the file the way many editors do, by renaming a new copy into place
+	tmp_file := filepath.Join(dir, ".credentials.swp")
+	edited := "[default]\naws_access_key_id = editedkey\naws_secret_access_key = editedsecret\n"
+	if write_err := ioutil.WriteFile(tmp_file, []byte(edited), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+	if rename_err := os.Rename(tmp_file, rs.CredentialsFile); rename_err != nil {
+		t.Fatal(rename_err.Error())
+	}
+	select {
+	case <-s:
+		accessKey, _ := rs.GetAccessKey()
+		if accessKey != "editedkey" {
+			t.Errorf("credentials were not re-read: %s", accessKey)
+		}
+	case watch_err := <-c:
+		t.Errorf("error from watcher: %v", watch_err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("no re-read after edit")
+	}
+	cancel()
+	for watch_err := range c {
+		if watch_err == context.Canceled {
+			break
+		}
+	}
+}
+
+func TestRolesSharedBothFiles(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_shared")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	credentials := "[both]\naws_access_key_id = credskey\naws_secret_access_key = credssecret\n\n" +
+		"[regiononly]\nregion = eu-west-1\n"
+	config := "[profile both]\naws_access_key_id = configkey\naws_secret_access_key = configsecret\n" +
+		"aws_session_token = configtoken\n\n" +
+		"[profile regiononly]\naws_access_key_id = configkey\naws_secret_access_key = configsecret\n"
+	rs := NewRolesShared()
+	rs.CredentialsFile = filepath.Join(dir, "credentials")
+	rs.ConfigFile = filepath.Join(dir, "config")
+	if write_err := ioutil.WriteFile(rs.CredentialsFile, []byte(credentials), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+	if write_err := ioutil.WriteFile(rs.ConfigFile, []byte(config), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+
+	// the credentials file section is used as a whole; the config file's token must not be
+	// paired with the credentials file's key
+	rs.Profile = "both"
+	if rr_err := rs.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, token, get_err := rs.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "credskey" || secret != "credssecret" || token != "" || rs.UsingIAM() {
+		t.Errorf("unexpected both profile data: %s %s %s", accessKey, secret, token)
+	}
+
+	// a credentials file section without a key falls back to the config file
+	rs.Profile = "regiononly"
+	if rr_err := rs.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, _ = rs.GetAccessKey()
+	if accessKey != "configkey" {
+		t.Errorf("unexpected regiononly profile data: %s", accessKey)
+	}
+}
+
+func TestRolesSharedWatchNilSignal(t *testing.T) {
+	dir := write_test_files(t)
+	defer os.RemoveAll(dir)
+	rs := NewRolesShared()
+	rs.CredentialsFile = filepath.Join(dir, "credentials")
+	rs.ConfigFile = filepath.Join(dir, "config")
+	rs.Profile = "default"
+	if rr_err := rs.RolesRead(); rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan error)
+	go func() {
+		// a write may be seen half done; those errors are not under test
+		for range c {
+		}
+	}()
+	go rs.RolesWatchContext(ctx, c, nil)
+	time.Sleep(500 * time.Millisecond)
+
+	// every edit is still picked up when nobody listens for the signal
+	for _, key := range []string{"firstkey", "secondkey"} {
+		edited := "[default]\naws_access_key_id = " + key + "\naws_secret_access_key = secret\n"
+		if write_err := ioutil.WriteFile(rs.CredentialsFile, []byte(edited), 0600); write_err != nil {
+			t.Fatal(write_err.Error())
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if accessKey, _ := rs.GetAccessKey(); accessKey == key {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not re-read", key)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	cancel()
+}
@@ -0,0 +1,150 @@
+package roles_sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ignored_headers are never signed, as proxies and transports may add or change them.
+var ignored_headers = map[string]bool{
+	"authorization":     true,
+	"user-agent":        true,
+	"x-amzn-trace-id":   true,
+	"expect":            true,
+	"transfer-encoding": true,
+	"connection":        true,
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256_hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// signing_key derives the SigV4 signing key for secret on date for region and service.
+func signing_key(secret, date, region, service string) []byte {
+	key := hmac_sha256([]byte("AWS4"+secret), date)
+	key = hmac_sha256(key, region)
+	key = hmac_sha256(key, service)
+	return hmac_sha256(key, "aws4_request")
+}
+
+// uri_encode percent-encodes every byte of s except the RFC 3986 unreserved characters,
+// and '/' if keep_slash is true.
+func uri_encode(s string, keep_slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keep_slash && c == '/') {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%")
+		b.WriteString(strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return b.String()
+}
+
+// canonical_uri returns the encoded path of u. Unless normalize is false (as for S3), dot
+// segments and repeated slashes are removed first.
+func canonical_uri(u *url.URL, normalize bool) string {
+	p := u.Path
+	if p == "" {
+		return "/"
+	}
+	if normalize {
+		trailing := strings.HasSuffix(p, "/")
+		p = path.Clean("/" + p)
+		if trailing && p != "/" {
+			p += "/"
+		}
+	}
+	return uri_encode(p, true)
+}
+
+// canonical_query returns the raw query sorted by key and then value, with every key and value
+// encoded the same way. Parameters listed in exclude are left out.
+func canonical_query(raw_query string, exclude ...string) string {
+	type pair struct{ k, v string }
+	pairs := make([]pair, 0)
+	for _, part := range strings.Split(raw_query, "&") {
+		if part == "" {
+			continue
+		}
+		k, v := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			k, v = part[:i], part[i+1:]
+		}
+		if uk, err := url.QueryUnescape(k); err == nil {
+			k = uk
+		}
+		if uv, err := url.QueryUnescape(v); err == nil {
+			v = uv
+		}
+		skip := false
+		for _, e := range exclude {
+			if k == e {
+				skip = true
+			}
+		}
+		if !skip {
+			pairs = append(pairs, pair{uri_encode(k, false), uri_encode(v, false)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].k != pairs[j].k {
+			return pairs[i].k < pairs[j].k
+		}
+		return pairs[i].v < pairs[j].v
+	})
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.k + "=" + p.v
+	}
+	return strings.Join(encoded, "&")
+}
+
+// canonical_headers returns the canonical header block and the signed header list for req,
+// always including host.
+func canonical_headers(req *http.Request) (string, string) {
+	headers := make(map[string][]string)
+	for name, values := range req.Header {
+		lname := strings.ToLower(name)
+		if ignored_headers[lname] {
+			continue
+		}
+		headers[lname] = append(headers[lname], values...)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers["host"] = []string{host}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		values := make([]string, len(headers[name]))
+		for i, v := range headers[name] {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
@@ -0,0 +1,94 @@
+package roles_sigv4
+
+import (
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MAX_PRESIGN_EXPIRY is the longest expiry SigV4 accepts for a presigned URL.
+const MAX_PRESIGN_EXPIRY = 7 * 24 * time.Hour
+
+// Presign returns rawurl with a query string signature allowing method for expiry from now.
+// See PresignAt.
+func Presign(r roles.RolesReader, method, rawurl, region, service string, expiry time.Duration) (string, error) {
+	return PresignAt(r, method, rawurl, region, service, expiry, time.Now())
+}
+
+// PresignAt returns rawurl with a query string signature allowing method from t until
+// t+expiry. X-Amz-Security-Token is included when r's Get returns a token. If r knows when
+// its credentials expire, an expiry past that time is refused, since the URL would stop
+// working early. For s3 the payload is UNSIGNED-PAYLOAD, as S3 expects.
+func PresignAt(r roles.RolesReader, method, rawurl, region, service string, expiry time.Duration,
+	t time.Time) (string, error) {
+	if r == nil {
+		return "", errors.New("roles_sigv4.Presign: nil RolesReader")
+	}
+	if expiry < time.Second || expiry > MAX_PRESIGN_EXPIRY {
+		e := fmt.Sprintf("roles_sigv4.Presign: expiry %s must be between 1s and %s",
+			expiry, MAX_PRESIGN_EXPIRY)
+		return "", errors.New(e)
+	}
+	if expiration, ok := roles.ExpiresAt(r); ok && t.Add(expiry).After(expiration) {
+		e := fmt.Sprintf("roles_sigv4.Presign: expiry %s is past the credential expiration %s",
+			expiry, expiration.UTC().Format(time.RFC3339))
+		return "", errors.New(e)
+	}
+	u, u_err := url.Parse(rawurl)
+	if u_err != nil {
+		e := fmt.Sprintf("roles_sigv4.Presign: bad url: %s", u_err.Error())
+		return "", errors.New(e)
+	}
+	if u.Host == "" {
+		return "", errors.New("roles_sigv4.Presign: url has no host")
+	}
+	accessKey, secret, token, get_err := r.Get()
+	if get_err != nil {
+		e := fmt.Sprintf("roles_sigv4.Presign: %s: %s", r.ProviderType(), get_err.Error())
+		return "", errors.New(e)
+	}
+
+	amz_date := t.UTC().Format(TIME_FORMAT)
+	scope := credential_scope(t.UTC().Format(DATE_FORMAT), region, service)
+	params := []string{
+		"X-Amz-Algorithm=" + ALGORITHM,
+		"X-Amz-Credential=" + uri_encode(accessKey+"/"+scope, false),
+		"X-Amz-Date=" + amz_date,
+		"X-Amz-Expires=" + strconv.FormatInt(int64(expiry/time.Second), 10),
+		"X-Amz-SignedHeaders=host",
+	}
+	if token != "" {
+		params = append(params, "X-Amz-Security-Token="+uri_encode(token, false))
+	}
+	if u.RawQuery != "" {
+		params = append(params, u.RawQuery)
+	}
+	query := canonical_query(strings.Join(params, "&"), "X-Amz-Signature")
+
+	req, req_err := http.NewRequest(method, u.String(), nil)
+	if req_err != nil {
+		e := fmt.Sprintf("roles_sigv4.Presign: %s", req_err.Error())
+		return "", errors.New(e)
+	}
+	payload_hash := sha256_hex(nil)
+	if service == "s3" {
+		payload_hash = UNSIGNED_PAYLOAD
+	}
+	headers, signed_headers := canonical_headers(req)
+	canonical_request := strings.Join([]string{
+		method,
+		canonical_uri(u, service != "s3"),
+		query,
+		headers,
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	u.RawQuery = query + "&X-Amz-Signature=" + signature(secret, amz_date, region, service, canonical_request)
+	return u.String(), nil
+}
@@ -0,0 +1,149 @@
+// Signs HTTP requests with AWS Signature Version 4 using the credentials of any RolesReader
+// (roles.go). The access key, secret and token are taken from a single Get call, so a rotation
+// by RolesWatch while a request is being signed can never produce a mixed signature.
+//
+package roles_sigv4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ALGORITHM   = "AWS4-HMAC-SHA256"
+	TIME_FORMAT = "20060102T150405Z"
+	DATE_FORMAT = "20060102"
+
+	DATE_HEADER           = "X-Amz-Date"
+	TOKEN_HEADER          = "X-Amz-Security-Token"
+	CONTENT_SHA256_HEADER = "X-Amz-Content-Sha256"
+
+	// UNSIGNED_PAYLOAD may be set as the X-Amz-Content-Sha256 header to skip hashing the body,
+	// where the service allows it.
+	UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+)
+
+// Signer signs requests for Service in Region with the credentials of Reader.
+type Signer struct {
+	Reader  roles.RolesReader
+	Service string
+	Region  string
+	// DisablePathNormalization leaves dot segments and repeated slashes in the path, as
+	// required by S3. It is set by NewSigner for the "s3" service.
+	DisablePathNormalization bool
+}
+
+// NewSigner returns a pointer to a Signer for r, service and region.
+func NewSigner(r roles.RolesReader, service, region string) *Signer {
+	s := new(Signer)
+	s.Reader = r
+	s.Service = service
+	s.Region = region
+	s.DisablePathNormalization = service == "s3"
+	return s
+}
+
+// Sign signs req as of now. See SignAt.
+func (s *Signer) Sign(req *http.Request) error {
+	return s.SignAt(req, time.Now())
+}
+
+// SignAt sets the Authorization and X-Amz-Date headers on req, and X-Amz-Security-Token if the
+// Reader's Get returns a token. Any previous signature is replaced. The body is read to hash it
+// and then restored, unless X-Amz-Content-Sha256 is already set.
+func (s *Signer) SignAt(req *http.Request, t time.Time) error {
+	if s.Reader == nil {
+		return errors.New("roles_sigv4.Sign: nil Reader")
+	}
+	accessKey, secret, token, get_err := s.Reader.Get()
+	if get_err != nil {
+		e := fmt.Sprintf("roles_sigv4.Sign: %s: %s", s.Reader.ProviderType(), get_err.Error())
+		return errors.New(e)
+	}
+	payload_hash, hash_err := payload_hash(req)
+	if hash_err != nil {
+		return hash_err
+	}
+	s.sign(req, payload_hash, accessKey, secret, token, t)
+	return nil
+}
+
+// payload_hash returns the hex SHA256 of the body of req, restoring the body afterwards.
+func payload_hash(req *http.Request) (string, error) {
+	if h := req.Header.Get(CONTENT_SHA256_HEADER); h != "" {
+		return h, nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return sha256_hex(nil), nil
+	}
+	body, body_err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if body_err != nil {
+		e := fmt.Sprintf("roles_sigv4.payload_hash: read err: %s", body_err.Error())
+		return "", errors.New(e)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return sha256_hex(body), nil
+}
+
+// sign computes the signature for one snapshot of credentials and sets the headers.
+func (s *Signer) sign(req *http.Request, payload_hash, accessKey, secret, token string, t time.Time) {
+	amz_date := t.UTC().Format(TIME_FORMAT)
+	date := t.UTC().Format(DATE_FORMAT)
+	req.Header.Del("Authorization")
+	req.Header.Set(DATE_HEADER, amz_date)
+	if token != "" {
+		req.Header.Set(TOKEN_HEADER, token)
+	} else {
+		req.Header.Del(TOKEN_HEADER)
+	}
+	if s.Service == "s3" && req.Header.Get(CONTENT_SHA256_HEADER) == "" {
+		req.Header.Set(CONTENT_SHA256_HEADER, payload_hash)
+	}
+
+	headers, signed_headers := canonical_headers(req)
+	canonical_request := strings.Join([]string{
+		req.Method,
+		canonical_uri(req.URL, !s.DisablePathNormalization),
+		canonical_query(req.URL.RawQuery),
+		headers,
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := credential_scope(date, s.Region, s.Service)
+	signature := signature(secret, amz_date, s.Region, s.Service, canonical_request)
+
+	req.Header.Set("Authorization", ALGORITHM+
+		" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signed_headers+
+		", Signature="+signature)
+}
+
+// credential_scope is the date/region/service/aws4_request scope of a signature.
+func credential_scope(date, region, service string) string {
+	return date + "/" + region + "/" + service + "/aws4_request"
+}
+
+// signature signs the canonical_request made at amz_date with a key derived from secret.
+func signature(secret, amz_date, region, service, canonical_request string) string {
+	date := amz_date[:len(DATE_FORMAT)]
+	string_to_sign := strings.Join([]string{
+		ALGORITHM,
+		amz_date,
+		credential_scope(date, region, service),
+		sha256_hex([]byte(canonical_request)),
+	}, "\n")
+	return hex.EncodeToString(hmac_sha256(signing_key(secret, date, region, service), string_to_sign))
+}
@@ -0,0 +1,115 @@
+package roles_sigv4
+
+import (
+	roles_master "github.com/smugmug/goawsroles/roles_master"
+	roles_simple "github.com/smugmug/goawsroles/roles_simple"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	test_access_key = "AKIDEXAMPLE"
+	test_secret     = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	test_time       = "20150830T123600Z"
+	test_credential = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "
+)
+
+// vectors from the AWS Signature Version 4 test suite
+var test_suite = []struct {
+	name    string
+	method  string
+	url     string
+	body    string
+	headers map[string]string
+	authz   string
+}{
+	{"get-vanilla", "GET", "https://example.amazonaws.com/", "", nil,
+		"SignedHeaders=host;x-amz-date, " +
+			"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{"get-vanilla-query-order-key-case", "GET", "https://example.amazonaws.com/?Param2=value2&Param1=value1", "", nil,
+		"SignedHeaders=host;x-amz-date, " +
+			"Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	{"get-vanilla-query-unreserved", "GET", "https://example.amazonaws.com/?" +
+		"-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz=" +
+		"-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz", "", nil,
+		"SignedHeaders=host;x-amz-date, " +
+			"Signature=9c3e54bfcdf0b19771a7f523ee5669cdf59bc7cc0884027167c21bb143a40197"},
+	{"get-utf8", "GET", "https://example.amazonaws.com/%E1%88%B4", "", nil,
+		"SignedHeaders=host;x-amz-date, " +
+			"Signature=8318018e0b0f223aa2bbf98705b62bb787dc9c0e678f255a891fd03141be5d85"},
+	{"get-space", "GET", "https://example.amazonaws.com/example%20space/", "", nil,
+		"SignedHeaders=host;x-amz-date, " +
+			"Signature=652487583200325589f1fba4c7e578f72c47cb61beeca81406b39ddec1366741"},
+	{"post-vanilla", "POST", "https://example.amazonaws.com/", "", nil,
+		"SignedHeaders=host;x-amz-date, " +
+			"Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	{"post-x-www-form-urlencoded", "POST", "https://example.amazonaws.com/", "Param1=value1",
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+		"SignedHeaders=content-type;host;x-amz-date, " +
+			"Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+}
+
+func TestSignerTestSuite(t *testing.T) {
+	signing_time, _ := time.Parse(TIME_FORMAT, test_time)
+	s := NewSigner(roles_master.NewRolesMaster(test_access_key, test_secret), "service", "us-east-1")
+	for _, v := range test_suite {
+		req, req_err := http.NewRequest(v.method, v.url, nil)
+		if req_err != nil {
+			t.Fatal(req_err.Error())
+		}
+		if v.body != "" {
+			req.Body = ioutil.NopCloser(strings.NewReader(v.body))
+		}
+		for k, h := range v.headers {
+			req.Header.Set(k, h)
+		}
+		if sign_err := s.SignAt(req, signing_time); sign_err != nil {
+			t.Fatal(sign_err.Error())
+		}
+		if got := req.Header.Get("Authorization"); got != test_credential+v.authz {
+			t.Errorf("%s: got %s", v.name, got)
+		}
+		if req.Header.Get(DATE_HEADER) != test_time {
+			t.Errorf("%s: unexpected %s: %s", v.name, DATE_HEADER, req.Header.Get(DATE_HEADER))
+		}
+		if v.body != "" {
+			body, _ := ioutil.ReadAll(req.Body)
+			if string(body) != v.body {
+				t.Errorf("%s: body was not restored after hashing: %s", v.name, body)
+			}
+		}
+	}
+}
+
+func TestSignerToken(t *testing.T) {
+	signing_time, _ := time.Parse(TIME_FORMAT, test_time)
+	rs := roles_simple.NewRolesSimple(test_access_key, test_secret, "session-token")
+	s := NewSigner(rs, "service", "us-east-1")
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if sign_err := s.SignAt(req, signing_time); sign_err != nil {
+		t.Fatal(sign_err.Error())
+	}
+	if req.Header.Get(TOKEN_HEADER) != "session-token" {
+		t.Errorf("%s was not set", TOKEN_HEADER)
+	}
+	if !strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("token is not signed: %s", req.Header.Get("Authorization"))
+	}
+
+	// signing again replaces the previous signature
+	first := req.Header.Get("Authorization")
+	if sign_err := s.SignAt(req, signing_time.Add(time.Second)); sign_err != nil {
+		t.Fatal(sign_err.Error())
+	}
+	if req.Header.Get("Authorization") == first {
+		t.Errorf("signature was not replaced")
+	}
+
+	rs.ZeroRoles()
+	if s.Sign(req) == nil {
+		t.Errorf("expected an error signing with empty credentials")
+	}
+}
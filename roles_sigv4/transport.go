@@ -0,0 +1,161 @@
+package roles_sigv4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// MAX_ERROR_BODY bounds how much of a 403 response is read to look for an expired token code.
+const MAX_ERROR_BODY = 64 * 1024
+
+// expired_codes are the error codes that mean the credentials were rotated or expired, and
+// may succeed after a RolesReread.
+var expired_codes = []string{"ExpiredToken", "InvalidClientTokenId"}
+
+// Transport is an http.RoundTripper that signs each request with the current credentials of
+// the Signer's Reader. If the response is a 403 with an expired token code and the Reader
+// implements roles.RolesRereader, it is forced to RolesReread and the request is signed and
+// sent once more. This hides the window where credentials have been rotated at the source
+// (e.g. on disk) but not yet reloaded. Readers without RolesReread are never re-read here,
+// as a failed RolesRead may discard credentials that are still good for other requests.
+type Transport struct {
+	Signer *Signer
+	// Base sends the signed requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	read_lock sync.Mutex
+}
+
+// NewTransport returns a pointer to a Transport signing with r for service and region.
+func NewTransport(r roles.RolesReader, service, region string) *Transport {
+	t := new(Transport)
+	t.Signer = NewSigner(r, service, region)
+	t.Base = http.DefaultTransport
+	return t
+}
+
+// RoundTrip signs a copy of req and sends it with Base, retrying once on an expired token.
+// req itself is not modified.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Signer == nil {
+		return nil, errors.New("roles_sigv4.RoundTrip: nil Signer")
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	signed := req.Clone(req.Context())
+	sign_err := t.Signer.Sign(signed)
+	if sign_err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, sign_err
+	}
+	resp, resp_err := base.RoundTrip(signed)
+	if resp_err != nil || !expired_response(resp) {
+		return resp, resp_err
+	}
+
+	// the body has to be sent again; without GetBody the 403 is all we have
+	if signed.Body != nil && signed.Body != http.NoBody && signed.GetBody == nil {
+		return resp, nil
+	}
+	read_err := t.reread(signed)
+	if read_err != nil {
+		log.Printf("roles_sigv4.RoundTrip: cannot reread credentials: %s\n", read_err.Error())
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if signed.GetBody != nil {
+		body, body_err := signed.GetBody()
+		if body_err != nil {
+			log.Printf("roles_sigv4.RoundTrip: cannot rewind body: %s\n", body_err.Error())
+			return resp, nil
+		}
+		retry.Body = body
+		retry.GetBody = signed.GetBody
+	}
+	sign_err = t.Signer.Sign(retry)
+	if sign_err != nil {
+		log.Printf("roles_sigv4.RoundTrip: cannot sign retry: %s\n", sign_err.Error())
+		return resp, nil
+	}
+	resp.Body.Close()
+	return base.RoundTrip(retry)
+}
+
+// reread forces the Reader to RolesReread, unless the credentials have already changed since
+// signed was signed. Concurrent requests that all see an expired token wait for a single read
+// rather than each hitting the source.
+func (t *Transport) reread(signed *http.Request) error {
+	rr, ok := t.Signer.Reader.(roles.RolesRereader)
+	if !ok {
+		e := fmt.Sprintf("%s: reader does not implement RolesReread", t.Signer.Reader.ProviderType())
+		return errors.New(e)
+	}
+	t.read_lock.Lock()
+	defer t.read_lock.Unlock()
+	accessKey, _, token, get_err := t.Signer.Reader.Get()
+	if get_err == nil && (signed_access_key(signed) != accessKey || signed.Header.Get(TOKEN_HEADER) != token) {
+		return nil
+	}
+	read_err := rr.RolesReread()
+	if read_err != nil {
+		e := fmt.Sprintf("%s: %s", t.Signer.Reader.ProviderType(), read_err.Error())
+		return errors.New(e)
+	}
+	return nil
+}
+
+// signed_access_key returns the access key named in the Authorization header of req.
+func signed_access_key(req *http.Request) string {
+	authz := req.Header.Get("Authorization")
+	i := strings.Index(authz, "Credential=")
+	if i == -1 {
+		return ""
+	}
+	authz = authz[i+len("Credential="):]
+	if j := strings.Index(authz, "/"); j != -1 {
+		return authz[:j]
+	}
+	return ""
+}
+
+// expired_response reports whether resp is a 403 naming an expired or invalid token. The
+// part of the body that is read is put back, so resp can still be returned to the caller.
+func expired_response(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+	// JSON protocols (e.g. DynamoDB) name the error in a header
+	if has_expired_code(resp.Header.Get("X-Amzn-ErrorType")) {
+		return true
+	}
+	if resp.Body == nil {
+		return false
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_ERROR_BODY))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	return has_expired_code(string(b))
+}
+
+func has_expired_code(s string) bool {
+	for _, code := range expired_codes {
+		if strings.Contains(s, code) {
+			return true
+		}
+	}
+	return false
+}
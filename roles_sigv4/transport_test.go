@@ -0,0 +1,255 @@
+package roles_sigv4
+
+import (
+	"encoding/json"
+	"fmt"
+	roles_files "github.com/smugmug/goawsroles/roles_files"
+	roles_imds "github.com/smugmug/goawsroles/roles_imds"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const test_role_json = `{"AccessKeyId":"%s","SecretAccessKey":"secret","Token":"%s"}`
+
+func write_role_json(t *testing.T, dir, accessKey, token string) {
+	j := fmt.Sprintf(test_role_json, accessKey, token)
+	write_err := ioutil.WriteFile(filepath.Join(dir, "role.json"), []byte(j), 0600)
+	if write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+}
+
+func TestTransportRetry(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_sigv4")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	write_role_json(t, dir, "oldkey", "oldtoken")
+	rf := roles_files.NewRolesFiles()
+	rf.BaseDir = dir
+	rf.JSONFile = "role.json"
+	if read_err := rf.RolesRead(); read_err != nil {
+		t.Fatal(read_err.Error())
+	}
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "Action=ListQueues" {
+			t.Errorf("unexpected body %q", body)
+		}
+		if r.Header.Get(TOKEN_HEADER) != "newtoken" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<ErrorResponse><Error><Code>ExpiredToken</Code></Error></ErrorResponse>"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewTransport(rf, "sqs", "us-east-1")}
+
+	// the credentials are rotated on disk, but RolesWatch has not reloaded them yet
+	write_role_json(t, dir, "newkey", "newtoken")
+	resp, resp_err := client.Post(ts.URL, "application/x-www-form-urlencoded",
+		strings.NewReader("Action=ListQueues"))
+	if resp_err != nil {
+		t.Fatal(resp_err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("retry failed: %d %s", resp.StatusCode, body)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	if accessKey, _ := rf.GetAccessKey(); accessKey != "newkey" {
+		t.Errorf("credentials were not reread: %s", accessKey)
+	}
+
+	// a rejection that persists after the reread is returned to the caller intact
+	atomic.StoreInt32(&requests, 0)
+	write_role_json(t, dir, "newkey", "othertoken")
+	rf.RolesRead()
+	resp, resp_err = client.Post(ts.URL, "application/x-www-form-urlencoded",
+		strings.NewReader("Action=ListQueues"))
+	if resp_err != nil {
+		t.Fatal(resp_err.Error())
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "ExpiredToken") {
+		t.Errorf("expected the 403 to be returned: %d %s", resp.StatusCode, body)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected exactly one retry, got %d requests", n)
+	}
+}
+
+func TestTransportNoRetry(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+	}))
+	defer ts.Close()
+	dir, _ := ioutil.TempDir("", "roles_sigv4")
+	defer os.RemoveAll(dir)
+	write_role_json(t, dir, "key", "token")
+	rf := roles_files.NewRolesFiles()
+	rf.BaseDir = dir
+	rf.JSONFile = "role.json"
+	rf.RolesRead()
+
+	client := &http.Client{Transport: NewTransport(rf, "sqs", "us-east-1")}
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, resp_err := client.Do(req)
+	if resp_err != nil {
+		t.Fatal(resp_err.Error())
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("AccessDenied should not be retried, got %d requests", n)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("the caller's request was modified")
+	}
+}
+
+func TestTransportFailedReread(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<ErrorResponse><Error><Code>ExpiredToken</Code></Error></ErrorResponse>"))
+	}))
+	defer ts.Close()
+	dir, dir_err := ioutil.TempDir("", "roles_sigv4")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	write_role_json(t, dir, "key", "token")
+	rf := roles_files.NewRolesFiles()
+	rf.BaseDir = dir
+	rf.JSONFile = "role.json"
+	if read_err := rf.RolesRead(); read_err != nil {
+		t.Fatal(read_err.Error())
+	}
+
+	// the file is caught half written; the failed reread must not zero the RolesFiles, which
+	// under ZERO_ON_ERROR would also forget the file names for good
+	if write_err := ioutil.WriteFile(filepath.Join(dir, "role.json"), []byte(`{"AccessKeyId":`), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+	client := &http.Client{Transport: NewTransport(rf, "sqs", "us-east-1")}
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, resp_err := client.Do(req)
+	if resp_err != nil {
+		t.Fatal(resp_err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the 403 to be returned, got %d", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("a failed reread should not be retried, got %d requests", n)
+	}
+	if accessKey, get_err := rf.GetAccessKey(); get_err != nil || accessKey != "key" {
+		t.Errorf("the credentials were not kept: %s %v", accessKey, get_err)
+	}
+	if rf.JSONFile != "role.json" {
+		t.Errorf("the file names were not kept: %q", rf.JSONFile)
+	}
+	write_role_json(t, dir, "fixedkey", "token")
+	if read_err := rf.RolesRead(); read_err != nil {
+		t.Fatal(read_err.Error())
+	}
+	if accessKey, _ := rf.GetAccessKey(); accessKey != "fixedkey" {
+		t.Errorf("RolesRead did not recover: %s", accessKey)
+	}
+}
+
+func TestTransportRetryIMDS(t *testing.T) {
+	var fetches, imds_down, rejecting int32
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == roles_imds.TOKEN_PATH:
+			w.Write([]byte("session-token"))
+		case atomic.LoadInt32(&imds_down) == 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == roles_imds.CREDENTIALS_PATH:
+			w.Write([]byte("test-role\n"))
+		case r.URL.Path == roles_imds.CREDENTIALS_PATH+"test-role":
+			n := atomic.AddInt32(&fetches, 1)
+			json.NewEncoder(w).Encode(map[string]string{
+				"Code":            "Success",
+				"AccessKeyId":     fmt.Sprintf("key%d", n),
+				"SecretAccessKey": "secret",
+				"Token":           "token",
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer imds.Close()
+	ri := roles_imds.NewRolesIMDS()
+	ri.Endpoint = imds.URL
+	if read_err := ri.RolesRead(); read_err != nil {
+		t.Fatal(read_err.Error())
+	}
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&rejecting) == 1 || signed_access_key(r) == "key1" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<ErrorResponse><Error><Code>ExpiredToken</Code></Error></ErrorResponse>"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	client := &http.Client{Transport: NewTransport(ri, "sqs", "us-east-1")}
+
+	// key1 has been revoked before its expiration; the retry fetches key2
+	resp, resp_err := client.Get(ts.URL)
+	if resp_err != nil {
+		t.Fatal(resp_err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("retry failed: %d", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	if accessKey, _ := ri.GetAccessKey(); accessKey != "key2" {
+		t.Errorf("credentials were not fetched again: %s", accessKey)
+	}
+
+	// a reread that fails while the metadata service is down keeps the current credentials
+	atomic.StoreInt32(&rejecting, 1)
+	atomic.StoreInt32(&imds_down, 1)
+	resp, resp_err = client.Get(ts.URL)
+	if resp_err != nil {
+		t.Fatal(resp_err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the 403 to be returned, got %d", resp.StatusCode)
+	}
+	if accessKey, get_err := ri.GetAccessKey(); get_err != nil || accessKey != "key2" {
+		t.Errorf("the credentials were not kept: %s %v", accessKey, get_err)
+	}
+}
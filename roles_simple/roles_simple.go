@@ -8,6 +8,7 @@ import (
 	"errors"
 	roles "github.com/smugmug/goawsroles/roles"
 	"sync"
+	"time"
 )
 
 const (
@@ -30,6 +31,14 @@ func NewRolesSimple(accessKey, secret, token string) *RolesSimple {
 	return r
 }
 
+// NewRolesSimpleWithExpiration returns a pointer to a RolesSimple instance whose credentials
+// are known to expire at expiration.
+func NewRolesSimpleWithExpiration(accessKey, secret, token string, expiration time.Time) *RolesSimple {
+	r := NewRolesSimple(accessKey, secret, token)
+	r.roleFields.Expiration = expiration
+	return r
+}
+
 // ProviderType is a descriptive string of the implementation.
 func (rf *RolesSimple) ProviderType() string {
 	return ROLE_PROVIDER
@@ -64,6 +73,20 @@ func (rf *RolesSimple) RolesWatch(err_chan chan error, read_signal chan bool) {
 	panic("RolesWatch not defined for RolesSimple as credentials are immutable")
 }
 
+// ExpiresAt returns the expiration of the current credentials, and false if it is not known.
+func (rf *RolesSimple) ExpiresAt() (time.Time, bool) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.ExpiresAt()
+}
+
+// IsExpired reports whether the current credentials expire within skew of now.
+func (rf *RolesSimple) IsExpired(skew time.Duration) bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsExpired(skew)
+}
+
 // Get returns the (accessKey,secret,token), or an error.
 func (rf *RolesSimple) Get() (string, string, string, error) {
 	rf.lock.RLock()
@@ -0,0 +1,244 @@
+// Implements the RolesReader interface (roles.go) for temporary credentials issued by AWS STS.
+// RolesAssumeRole assumes a role using the credentials of another RolesReader, such as a
+// RolesFiles or RolesMaster, and keeps the assumed role credentials fresh in RolesWatch.
+// RolesWebIdentity exchanges a web identity token file, such as a Kubernetes service-account
+// token, for role credentials.
+//
+package roles_sts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	roles_sigv4 "github.com/smugmug/goawsroles/roles_sigv4"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_PROVIDER = "sts"
+)
+
+// RolesAssumeRole holds credentials for RoleArn obtained with the credentials of Source.
+type RolesAssumeRole struct {
+	// Source provides the credentials used to sign the AssumeRole request.
+	Source      roles.RolesReader
+	RoleArn     string
+	SessionName string
+	// ExternalId is sent if not empty.
+	ExternalId string
+	// Duration is the requested lifetime of the credentials. If zero, the STS default is used.
+	Duration time.Duration
+	// MFASerial is the serial number or ARN of an MFA device, sent if not empty along with
+	// the code returned by MFATokenCode.
+	MFASerial    string
+	MFATokenCode func() (string, error)
+	// Region selects a regional STS endpoint and the signing region. If empty, the global
+	// endpoint and us-east-1 are used.
+	Region string
+	// Endpoint overrides the STS endpoint URL.
+	Endpoint string
+	// Client is used for requests to STS.
+	Client *http.Client
+	// Refresher controls how far ahead of Expiration RolesWatch assumes the role again.
+	Refresher roles.Refresher
+
+	fetch_lock sync.Mutex
+	roleFields *roles.RolesFields
+	lock       sync.RWMutex
+}
+
+// NewRolesAssumeRole returns a pointer to a RolesAssumeRole instance for roleArn, signed with the
+// credentials of source.
+func NewRolesAssumeRole(source roles.RolesReader, roleArn, sessionName string) *RolesAssumeRole {
+	r := new(RolesAssumeRole)
+	r.Source = source
+	r.RoleArn = roleArn
+	r.SessionName = sessionName
+	r.Client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	r.roleFields = roles.NewRolesFields()
+	return r
+}
+
+// ProviderType is a descriptive string of the implementation.
+func (rf *RolesAssumeRole) ProviderType() string {
+	return ROLE_PROVIDER
+}
+
+// UsingIAM tells us if the credentials provided by this role are temporary credentials which
+// also have a Token component, or if they are durable key/secret-only credentials.
+func (rf *RolesAssumeRole) UsingIAM() bool {
+	return true
+}
+
+// IsEmpty determines if a RolesAssumeRole struct is uninitialized.
+func (rf *RolesAssumeRole) IsEmpty() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsEmpty()
+}
+
+// ZeroRoles recreate the RolesAssumeRole credentials as initialized by NewRolesAssumeRole.
+// The Source is left untouched.
+func (rf *RolesAssumeRole) ZeroRoles() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.lock.Unlock()
+}
+
+// RolesRead populates rolesFields with a blocking AssumeRole call.
+func (rf *RolesAssumeRole) RolesRead() error {
+	roles_err := rf.rolesAssumeRoleRead()
+	if roles_err != nil {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. It calls AssumeRole like RolesRead, but on failure
+// the current credentials are kept.
+func (rf *RolesAssumeRole) RolesReread() error {
+	return rf.rolesAssumeRoleRead()
+}
+
+// RolesWatch assumes the role again ahead of Expiration. See RolesWatchContext.
+func (rf *RolesAssumeRole) RolesWatch(err_chan chan error, read_signal chan bool) {
+	rf.RolesWatchContext(context.Background(), err_chan, read_signal)
+}
+
+// RolesWatchContext assumes the role again ahead of Expiration until ctx is done, signalling each
+// refresh on read_signal. Failed calls are sent on err_chan and retried, leaving the current
+// credentials in place until they expire. ctx.Err() is the final value sent on err_chan.
+// The Source is read through Get on every call, so it may be watched independently.
+func (rf *RolesAssumeRole) RolesWatchContext(ctx context.Context, err_chan chan error, read_signal chan bool) {
+	log.Printf("initiate roles watching\n")
+	rf.Refresher.Watch(ctx, err_chan, read_signal, rf.rolesAssumeRoleRead, rf.ExpiresAt)
+	log.Printf("terminating roles watching\n")
+}
+
+// ExpiresAt returns the expiration of the current credentials, and false if it is not known.
+func (rf *RolesAssumeRole) ExpiresAt() (time.Time, bool) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.ExpiresAt()
+}
+
+// IsExpired reports whether the current credentials expire within skew of now.
+func (rf *RolesAssumeRole) IsExpired(skew time.Duration) bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsExpired(skew)
+}
+
+// Get returns the (accessKey,secret,token), or an error.
+func (rf *RolesAssumeRole) Get() (string, string, string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	accessKey := ""
+	if rf.roleFields.AccessKey == "" {
+		return "", "", "", errors.New("roles_sts.Get: empty AccessKey")
+	} else {
+		accessKey = rf.roleFields.AccessKey
+	}
+	secret := ""
+	if rf.roleFields.Secret == "" {
+		return "", "", "", errors.New("roles_sts.Get: empty Secret")
+	} else {
+		secret = rf.roleFields.Secret
+	}
+	token := ""
+	if rf.roleFields.Token == "" {
+		return "", "", "", errors.New("roles_sts.Get: empty Token")
+	} else {
+		token = rf.roleFields.Token
+	}
+	return accessKey, secret, token, nil
+}
+
+// GetAccessKey returns the accessKey or an error.
+func (rf *RolesAssumeRole) GetAccessKey() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.AccessKey == "" {
+		return "", errors.New("roles_sts.GetAccessKey: empty AccessKey")
+	} else {
+		return rf.roleFields.AccessKey, nil
+	}
+}
+
+// GetSecret returns the secret or an error.
+func (rf *RolesAssumeRole) GetSecret() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Secret == "" {
+		return "", errors.New("roles_sts.GetSecret: empty Secret")
+	} else {
+		return rf.roleFields.Secret, nil
+	}
+}
+
+// GetToken returns the token or an error.
+func (rf *RolesAssumeRole) GetToken() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Token == "" {
+		return "", errors.New("roles_sts.GetToken: empty Token")
+	} else {
+		return rf.roleFields.Token, nil
+	}
+}
+
+// will call AssumeRole with the current Source credentials and swap the result in at once.
+// readers are only blocked for the swap, not for the request.
+func (rf *RolesAssumeRole) rolesAssumeRoleRead() error {
+	rf.fetch_lock.Lock()
+	defer rf.fetch_lock.Unlock()
+	if rf.Source == nil {
+		return errors.New("roles_sts.rolesAssumeRoleRead: nil Source")
+	}
+	if rf.RoleArn == "" {
+		return errors.New("roles_sts.rolesAssumeRoleRead: empty RoleArn")
+	}
+	if rf.SessionName == "" {
+		return errors.New("roles_sts.rolesAssumeRoleRead: empty SessionName")
+	}
+	params := url.Values{}
+	params.Set("Action", "AssumeRole")
+	params.Set("RoleArn", rf.RoleArn)
+	params.Set("RoleSessionName", rf.SessionName)
+	if rf.ExternalId != "" {
+		params.Set("ExternalId", rf.ExternalId)
+	}
+	if rf.Duration > 0 {
+		params.Set("DurationSeconds", fmt.Sprintf("%d", int(rf.Duration/time.Second)))
+	}
+	if rf.MFASerial != "" {
+		if rf.MFATokenCode == nil {
+			return errors.New("roles_sts.rolesAssumeRoleRead: MFASerial set without MFATokenCode")
+		}
+		code, code_err := rf.MFATokenCode()
+		if code_err != nil {
+			e := fmt.Sprintf("roles_sts.rolesAssumeRoleRead: MFA token code: %s", code_err.Error())
+			return errors.New(e)
+		}
+		params.Set("SerialNumber", rf.MFASerial)
+		params.Set("TokenCode", code)
+	}
+
+	endpoint, region := sts_endpoint(rf.Endpoint, rf.Region)
+	signer := roles_sigv4.NewSigner(rf.Source, "sts", region)
+	fields, call_err := sts_call(rf.Client, endpoint, params, signer.Sign)
+	if call_err != nil {
+		return call_err
+	}
+	rf.lock.Lock()
+	*rf.roleFields = *fields
+	rf.lock.Unlock()
+	log.Printf("roles_sts.rolesAssumeRoleRead: succesful assignment of role data\n")
+	return nil
+}
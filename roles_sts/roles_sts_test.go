@@ -0,0 +1,108 @@
+package roles_sts
+
+import (
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	roles_master "github.com/smugmug/goawsroles/roles_master"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const assume_role_response = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/demo/test-session</Arn>
+      <AssumedRoleId>ARO123EXAMPLE123:test-session</AssumedRoleId>
+    </AssumedRoleUser>
+    <Credentials>
+      <AccessKeyId>assumedkey</AccessKeyId>
+      <SecretAccessKey>assumedsecret</SecretAccessKey>
+      <SessionToken>assumedtoken</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+  <ResponseMetadata>
+    <RequestId>c6104cbe-af31-11e0-8154-cbc7ccf896c7</RequestId>
+  </ResponseMetadata>
+</AssumeRoleResponse>`
+
+const error_response = `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>AccessDenied</Code>
+    <Message>not authorized to perform sts:AssumeRole</Message>
+  </Error>
+</ErrorResponse>`
+
+func TestRolesAssumeRole(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=masterkey/") ||
+			!strings.Contains(auth, "/us-west-2/sts/aws4_request") ||
+			r.Header.Get("X-Amz-Security-Token") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, error_response)
+			return
+		}
+		if r.FormValue("Action") != "AssumeRole" ||
+			r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/demo" ||
+			r.FormValue("RoleSessionName") != "test-session" ||
+			r.FormValue("ExternalId") != "external" ||
+			r.FormValue("DurationSeconds") != "900" ||
+			r.FormValue("SerialNumber") != "mfa-device" ||
+			r.FormValue("TokenCode") != "123456" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, assume_role_response, time.Now().Add(15*time.Minute).UTC().Format(time.RFC3339))
+	}))
+	defer ts.Close()
+
+	source := roles_master.NewRolesMaster("masterkey", "mastersecret")
+	ra := NewRolesAssumeRole(source, "arn:aws:iam::123456789012:role/demo", "test-session")
+	ra.Endpoint = ts.URL
+	ra.Region = "us-west-2"
+	ra.ExternalId = "external"
+	ra.Duration = 15 * time.Minute
+	ra.MFASerial = "mfa-device"
+	ra.MFATokenCode = func() (string, error) { return "123456", nil }
+	rr_err := roles.RolesReader(ra).RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, token, get_err := ra.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "assumedkey" || secret != "assumedsecret" || token != "assumedtoken" {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+	if ra.IsExpired(time.Minute) {
+		t.Errorf("credentials should not be expired")
+	}
+}
+
+func TestRolesAssumeRoleDenied(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, error_response)
+	}))
+	defer ts.Close()
+
+	source := roles_master.NewRolesMaster("masterkey", "mastersecret")
+	ra := NewRolesAssumeRole(source, "arn:aws:iam::123456789012:role/demo", "test-session")
+	ra.Endpoint = ts.URL
+	rr_err := ra.RolesRead()
+	if rr_err == nil {
+		t.Fatal("expected an AccessDenied error")
+	}
+	if !strings.Contains(rr_err.Error(), "AccessDenied") {
+		t.Errorf("error does not carry the STS code: %s", rr_err.Error())
+	}
+	if !ra.IsEmpty() {
+		t.Errorf("failed read should leave RolesAssumeRole empty")
+	}
+}
@@ -0,0 +1,314 @@
+package roles_sts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	fsnotify "github.com/howeyc/fsnotify"
+	fswatch "github.com/smugmug/goawsroles/internal/fswatch"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEB_IDENTITY_ROLE_PROVIDER = "web_identity"
+
+	ROLE_ARN_ENV                = "AWS_ROLE_ARN"
+	WEB_IDENTITY_TOKEN_FILE_ENV = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	ROLE_SESSION_NAME_ENV       = "AWS_ROLE_SESSION_NAME"
+)
+
+// RolesWebIdentity holds credentials for RoleArn obtained by exchanging the OIDC token in
+// TokenFile, such as a Kubernetes projected service-account token, with
+// AssumeRoleWithWebIdentity. That call is not signed, so no source credentials are needed.
+type RolesWebIdentity struct {
+	RoleArn string
+	// TokenFile holds the web identity token. It is re-read on every call.
+	TokenFile   string
+	SessionName string
+	// Duration is the requested lifetime of the credentials. If zero, the STS default is used.
+	Duration time.Duration
+	// Region selects a regional STS endpoint. If empty, the global endpoint is used.
+	Region string
+	// Endpoint overrides the STS endpoint URL.
+	Endpoint string
+	// Client is used for requests to STS.
+	Client *http.Client
+	// Refresher controls how far ahead of Expiration RolesWatch assumes the role again.
+	Refresher roles.Refresher
+
+	fetch_lock sync.Mutex
+	roleFields *roles.RolesFields
+	lock       sync.RWMutex
+}
+
+// NewRolesWebIdentity returns a pointer to a RolesWebIdentity instance configured from
+// AWS_ROLE_ARN, AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_SESSION_NAME. If no session name is
+// set, one is generated.
+func NewRolesWebIdentity() *RolesWebIdentity {
+	r := new(RolesWebIdentity)
+	r.RoleArn = os.Getenv(ROLE_ARN_ENV)
+	r.TokenFile = os.Getenv(WEB_IDENTITY_TOKEN_FILE_ENV)
+	r.SessionName = os.Getenv(ROLE_SESSION_NAME_ENV)
+	if r.SessionName == "" {
+		r.SessionName = fmt.Sprintf("goawsroles-%d", time.Now().UnixNano())
+	}
+	r.Region = os.Getenv("AWS_REGION")
+	r.Client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	r.roleFields = roles.NewRolesFields()
+	return r
+}
+
+// ProviderType is a descriptive string of the implementation.
+func (rf *RolesWebIdentity) ProviderType() string {
+	return WEB_IDENTITY_ROLE_PROVIDER
+}
+
+// UsingIAM tells us if the credentials provided by this role are temporary credentials which
+// also have a Token component, or if they are durable key/secret-only credentials.
+func (rf *RolesWebIdentity) UsingIAM() bool {
+	return true
+}
+
+// IsEmpty determines if a RolesWebIdentity struct is uninitialized.
+func (rf *RolesWebIdentity) IsEmpty() bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsEmpty()
+}
+
+// ZeroRoles recreate the RolesWebIdentity credentials as initialized by NewRolesWebIdentity.
+func (rf *RolesWebIdentity) ZeroRoles() {
+	rf.lock.Lock()
+	rf.roleFields.ZeroRoles()
+	rf.lock.Unlock()
+}
+
+// RolesRead populates rolesFields with a blocking AssumeRoleWithWebIdentity call.
+func (rf *RolesWebIdentity) RolesRead() error {
+	roles_err := rf.rolesWebIdentityRead()
+	if roles_err != nil {
+		rf.ZeroRoles()
+		return roles_err
+	}
+	return nil
+}
+
+// RolesReread implements roles.RolesRereader. It calls AssumeRoleWithWebIdentity like RolesRead,
+// but on failure the current credentials are kept.
+func (rf *RolesWebIdentity) RolesReread() error {
+	return rf.rolesWebIdentityRead()
+}
+
+// RolesWatch assumes the role again ahead of Expiration or when the token file rotates.
+// See RolesWatchContext.
+func (rf *RolesWebIdentity) RolesWatch(err_chan chan error, read_signal chan bool) {
+	rf.RolesWatchContext(context.Background(), err_chan, read_signal)
+}
+
+// RolesWatchContext assumes the role again ahead of Expiration, and whenever fsnotify reports
+// that the contents of TokenFile have changed, until ctx is done. Each refresh is signalled
+// on read_signal. Failed calls and fsnotify errors are sent on err_chan; failed calls are
+// retried, leaving the current credentials in place until they expire. ctx.Err() is the final
+// value sent on err_chan.
+func (rf *RolesWebIdentity) RolesWatchContext(ctx context.Context, err_chan chan error, read_signal chan bool) {
+	log.Printf("initiate roles watching\n")
+	watch_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	notify := make(chan bool)
+	watcher, watcher_err := fsnotify.NewWatcher()
+	if watcher_err == nil {
+		// watch the directory so that replacing the file, or swapping the ..data
+		// symlink of a projected volume, is seen
+		watcher_err = watcher.Watch(filepath.Dir(rf.TokenFile))
+		if watcher_err != nil {
+			watcher.Close()
+		}
+	}
+	if watcher_err != nil {
+		e := fmt.Sprintf("roles_sts.RolesWatch: cannot watch token file, "+
+			"refreshing on expiration only: %s", watcher_err.Error())
+		select {
+		case err_chan <- errors.New(e):
+		case <-ctx.Done():
+		}
+	} else {
+		go rf.watchTokenFile(watch_ctx, watcher, notify, err_chan)
+	}
+	rf.Refresher.WatchNotify(ctx, err_chan, read_signal, notify, rf.rolesWebIdentityRead, rf.ExpiresAt)
+	log.Printf("terminating roles watching\n")
+}
+
+// watchTokenFile sends on notify when an event in the token file's directory leaves the token
+// file with new contents. Errors from fsnotify are sent on err_chan. It closes watcher when ctx
+// is done.
+func (rf *RolesWebIdentity) watchTokenFile(ctx context.Context, watcher *fsnotify.Watcher, notify chan bool,
+	err_chan chan error) {
+	defer func() {
+		watcher.Close()
+		go fswatch.Drain(watcher)
+	}()
+	last, _ := ioutil.ReadFile(rf.TokenFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-watcher.Event:
+			if !ok {
+				return
+			}
+			if ev.IsDelete() {
+				continue
+			}
+			current, read_err := ioutil.ReadFile(rf.TokenFile)
+			if read_err != nil || len(current) == 0 || bytes.Equal(current, last) {
+				continue
+			}
+			last = current
+			log.Printf("roles_sts.RolesWatch: token file rotated on %s\n", ev.String())
+			select {
+			case notify <- true:
+			case <-ctx.Done():
+				return
+			}
+		case err, ok := <-watcher.Error:
+			if !ok {
+				return
+			}
+			e := fmt.Sprintf("roles_sts.RolesWatch: token file watch: %s", err.Error())
+			select {
+			case err_chan <- errors.New(e):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// ExpiresAt returns the expiration of the current credentials, and false if it is not known.
+func (rf *RolesWebIdentity) ExpiresAt() (time.Time, bool) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.ExpiresAt()
+}
+
+// IsExpired reports whether the current credentials expire within skew of now.
+func (rf *RolesWebIdentity) IsExpired(skew time.Duration) bool {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	return rf.roleFields.IsExpired(skew)
+}
+
+// Get returns the (accessKey,secret,token), or an error.
+func (rf *RolesWebIdentity) Get() (string, string, string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	accessKey := ""
+	if rf.roleFields.AccessKey == "" {
+		return "", "", "", errors.New("roles_sts.Get: empty AccessKey")
+	} else {
+		accessKey = rf.roleFields.AccessKey
+	}
+	secret := ""
+	if rf.roleFields.Secret == "" {
+		return "", "", "", errors.New("roles_sts.Get: empty Secret")
+	} else {
+		secret = rf.roleFields.Secret
+	}
+	token := ""
+	if rf.roleFields.Token == "" {
+		return "", "", "", errors.New("roles_sts.Get: empty Token")
+	} else {
+		token = rf.roleFields.Token
+	}
+	return accessKey, secret, token, nil
+}
+
+// GetAccessKey returns the accessKey or an error.
+func (rf *RolesWebIdentity) GetAccessKey() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.AccessKey == "" {
+		return "", errors.New("roles_sts.GetAccessKey: empty AccessKey")
+	} else {
+		return rf.roleFields.AccessKey, nil
+	}
+}
+
+// GetSecret returns the secret or an error.
+func (rf *RolesWebIdentity) GetSecret() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Secret == "" {
+		return "", errors.New("roles_sts.GetSecret: empty Secret")
+	} else {
+		return rf.roleFields.Secret, nil
+	}
+}
+
+// GetToken returns the token or an error.
+func (rf *RolesWebIdentity) GetToken() (string, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+	if rf.roleFields.Token == "" {
+		return "", errors.New("roles_sts.GetToken: empty Token")
+	} else {
+		return rf.roleFields.Token, nil
+	}
+}
+
+// will read the web identity token, exchange it for credentials and swap them in at once.
+// readers are only blocked for the swap, not for the request.
+func (rf *RolesWebIdentity) rolesWebIdentityRead() error {
+	rf.fetch_lock.Lock()
+	defer rf.fetch_lock.Unlock()
+	if rf.RoleArn == "" {
+		return errors.New("roles_sts.rolesWebIdentityRead: empty RoleArn")
+	}
+	if rf.TokenFile == "" {
+		return errors.New("roles_sts.rolesWebIdentityRead: empty TokenFile")
+	}
+	if rf.SessionName == "" {
+		return errors.New("roles_sts.rolesWebIdentityRead: empty SessionName")
+	}
+	token_bytes, token_err := ioutil.ReadFile(rf.TokenFile)
+	if token_err != nil {
+		e := fmt.Sprintf("roles_sts.rolesWebIdentityRead: %s read err: %s",
+			rf.TokenFile, token_err.Error())
+		return errors.New(e)
+	}
+	web_token := strings.TrimSpace(string(token_bytes))
+	if web_token == "" {
+		e := fmt.Sprintf("roles_sts.rolesWebIdentityRead: %s is empty", rf.TokenFile)
+		return errors.New(e)
+	}
+
+	params := url.Values{}
+	params.Set("Action", "AssumeRoleWithWebIdentity")
+	params.Set("RoleArn", rf.RoleArn)
+	params.Set("RoleSessionName", rf.SessionName)
+	params.Set("WebIdentityToken", web_token)
+	if rf.Duration > 0 {
+		params.Set("DurationSeconds", fmt.Sprintf("%d", int(rf.Duration/time.Second)))
+	}
+
+	endpoint, _ := sts_endpoint(rf.Endpoint, rf.Region)
+	fields, call_err := sts_call(rf.Client, endpoint, params, nil)
+	if call_err != nil {
+		return call_err
+	}
+	rf.lock.Lock()
+	*rf.roleFields = *fields
+	rf.lock.Unlock()
+	log.Printf("roles_sts.rolesWebIdentityRead: succesful assignment of role data\n")
+	return nil
+}
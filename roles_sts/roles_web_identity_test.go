@@ -0,0 +1,140 @@
+package roles_sts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	fsnotify "github.com/howeyc/fsnotify"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const web_identity_response = `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <SubjectFromWebIdentityToken>system:serviceaccount:default:demo</SubjectFromWebIdentityToken>
+    <Credentials>
+      <SessionToken>webtoken</SessionToken>
+      <SecretAccessKey>websecret</SecretAccessKey>
+      <Expiration>%s</Expiration>
+      <AccessKeyId>key-%s</AccessKeyId>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`
+
+func fake_web_identity_sts() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" ||
+			r.FormValue("Action") != "AssumeRoleWithWebIdentity" ||
+			r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/demo" ||
+			r.FormValue("RoleSessionName") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, web_identity_response,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339), r.FormValue("WebIdentityToken"))
+	}))
+}
+
+func TestRolesWebIdentity(t *testing.T) {
+	ts := fake_web_identity_sts()
+	defer ts.Close()
+
+	dir, dir_err := ioutil.TempDir("", "roles_sts")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	token_file := filepath.Join(dir, "token")
+	if write_err := ioutil.WriteFile(token_file, []byte("jwt1\n"), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+
+	os.Setenv(ROLE_ARN_ENV, "arn:aws:iam::123456789012:role/demo")
+	os.Setenv(WEB_IDENTITY_TOKEN_FILE_ENV, token_file)
+	defer os.Unsetenv(ROLE_ARN_ENV)
+	defer os.Unsetenv(WEB_IDENTITY_TOKEN_FILE_ENV)
+	rw := NewRolesWebIdentity()
+	rw.Endpoint = ts.URL
+	if !strings.HasPrefix(rw.SessionName, "goawsroles-") {
+		t.Errorf("unexpected generated session name: %s", rw.SessionName)
+	}
+	rr_err := rw.RolesRead()
+	if rr_err != nil {
+		t.Fatal(rr_err.Error())
+	}
+	accessKey, secret, token, get_err := rw.Get()
+	if get_err != nil {
+		t.Fatal(get_err.Error())
+	}
+	if accessKey != "key-jwt1" || secret != "websecret" || token != "webtoken" {
+		t.Errorf("unexpected role data: %s %s %s", accessKey, secret, token)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan error)
+	s := make(chan bool)
+	go rw.RolesWatchContext(ctx, c, s)
+	time.Sleep(500 * time.Millisecond)
+
+	// rotate the token the way a projected volume does, by renaming a new file into place
+	tmp_file := filepath.Join(dir, ".token.tmp")
+	if write_err := ioutil.WriteFile(tmp_file, []byte("jwt2\n"), 0600); write_err != nil {
+		t.Fatal(write_err.Error())
+	}
+	if rename_err := os.Rename(tmp_file, token_file); rename_err != nil {
+		t.Fatal(rename_err.Error())
+	}
+	select {
+	case <-s:
+		accessKey, _ := rw.GetAccessKey()
+		if accessKey != "key-jwt2" {
+			t.Errorf("credentials were not refreshed with the new token: %s", accessKey)
+		}
+	case watch_err := <-c:
+		t.Errorf("error from watcher: %v", watch_err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("no refresh after token rotation")
+	}
+	cancel()
+	for watch_err := range c {
+		if watch_err == context.Canceled {
+			break
+		}
+	}
+}
+
+func TestWebIdentityWatchError(t *testing.T) {
+	dir, dir_err := ioutil.TempDir("", "roles_sts")
+	if dir_err != nil {
+		t.Fatal(dir_err.Error())
+	}
+	defer os.RemoveAll(dir)
+	rw := NewRolesWebIdentity()
+	rw.TokenFile = filepath.Join(dir, "token")
+	watcher, watcher_err := fsnotify.NewWatcher()
+	if watcher_err != nil {
+		t.Fatal(watcher_err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notify := make(chan bool)
+	c := make(chan error)
+	go rw.watchTokenFile(ctx, watcher, notify, c)
+
+	// a broken token watch must be reported rather than silently leave expiry-only refreshes
+	watcher.Error <- errors.New("queue overflow")
+	select {
+	case watch_err := <-c:
+		if !strings.Contains(watch_err.Error(), "queue overflow") {
+			t.Errorf("unexpected error: %s", watch_err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fsnotify error was not forwarded")
+	}
+}
@@ -0,0 +1,145 @@
+package roles_sts
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	roles "github.com/smugmug/goawsroles/roles"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DEFAULT_ENDPOINT is the global STS endpoint, used when no Region or Endpoint is set.
+	DEFAULT_ENDPOINT = "https://sts.amazonaws.com"
+	// DEFAULT_REGION is the signing region for DEFAULT_ENDPOINT.
+	DEFAULT_REGION = "us-east-1"
+	// DEFAULT_TIMEOUT bounds each request to STS.
+	DEFAULT_TIMEOUT = 10 * time.Second
+
+	STS_VERSION = "2011-06-15"
+)
+
+// sts_credentials is the Credentials element shared by the AssumeRole* responses.
+type sts_credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string
+}
+
+// sts_result captures the Credentials of any AssumeRole* response, regardless of the name of
+// the enclosing Result element.
+type sts_result struct {
+	Results []struct {
+		Credentials *sts_credentials `xml:"Credentials"`
+	} `xml:",any"`
+}
+
+type sts_error struct {
+	Error struct {
+		Code    string
+		Message string
+	}
+}
+
+// sts_endpoint returns the endpoint and signing region for the given overrides.
+func sts_endpoint(endpoint, region string) (string, string) {
+	if region == "" {
+		region = DEFAULT_REGION
+		if endpoint == "" {
+			endpoint = DEFAULT_ENDPOINT
+		}
+	}
+	if endpoint == "" {
+		endpoint = "https://sts." + region + ".amazonaws.com"
+	}
+	return strings.TrimRight(endpoint, "/") + "/", region
+}
+
+// sts_call POSTs the query API form params to endpoint. If sign is not nil it is used to
+// sign the request. The returned credentials are validated to contain a token.
+func sts_call(client *http.Client, endpoint string, params url.Values,
+	sign func(req *http.Request) error) (*roles.RolesFields, error) {
+	action := params.Get("Action")
+	params.Set("Version", STS_VERSION)
+	body := []byte(params.Encode())
+	req, req_err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if req_err != nil {
+		return nil, req_err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if sign != nil {
+		sign_err := sign(req)
+		if sign_err != nil {
+			e := fmt.Sprintf("roles_sts.%s: %s", action, sign_err.Error())
+			return nil, errors.New(e)
+		}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, resp_err := client.Do(req)
+	if resp_err != nil {
+		e := fmt.Sprintf("roles_sts.%s: %s", action, resp_err.Error())
+		return nil, errors.New(e)
+	}
+	defer resp.Body.Close()
+	resp_body, body_err := ioutil.ReadAll(resp.Body)
+	if body_err != nil {
+		e := fmt.Sprintf("roles_sts.%s: read err: %s", action, body_err.Error())
+		return nil, errors.New(e)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var se sts_error
+		if xml.Unmarshal(resp_body, &se) == nil && se.Error.Code != "" {
+			e := fmt.Sprintf("roles_sts.%s: status %d: %s: %s",
+				action, resp.StatusCode, se.Error.Code, se.Error.Message)
+			return nil, errors.New(e)
+		}
+		e := fmt.Sprintf("roles_sts.%s: status %d", action, resp.StatusCode)
+		return nil, errors.New(e)
+	}
+	return parse_sts_response(action, resp_body)
+}
+
+// parse_sts_response extracts the Credentials from an AssumeRole* response body.
+func parse_sts_response(action string, b []byte) (*roles.RolesFields, error) {
+	var sr sts_result
+	xml_err := xml.Unmarshal(b, &sr)
+	if xml_err != nil {
+		e := fmt.Sprintf("roles_sts.%s: cannot decode response: %s", action, xml_err.Error())
+		return nil, errors.New(e)
+	}
+	var creds *sts_credentials
+	for _, r := range sr.Results {
+		if r.Credentials != nil {
+			creds = r.Credentials
+			break
+		}
+	}
+	if creds == nil {
+		e := fmt.Sprintf("roles_sts.%s: no Credentials in response", action)
+		return nil, errors.New(e)
+	}
+	rj := roles.RolesJSON{
+		AccessKeyId:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiration:      creds.Expiration,
+	}
+	fields, fields_err := rj.RolesFields()
+	if fields_err != nil {
+		e := fmt.Sprintf("roles_sts.%s: %s", action, fields_err.Error())
+		return nil, errors.New(e)
+	}
+	if fields.Token == "" {
+		e := fmt.Sprintf("roles_sts.%s: empty SessionToken", action)
+		return nil, errors.New(e)
+	}
+	return fields, nil
+}